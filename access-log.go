@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Formats of the access log, selected with LOG_FORMAT
+const (
+	accessLogText   = "text"
+	accessLogJSON   = "json"
+	accessLogApache = "apache"
+)
+
+// Only this much of a request body is logged
+const accessLogMaxBody = 4 << 10
+
+const requestIDHeader = "X-Request-ID"
+
+var accessLogFormat = accessLogText
+var accessLogBodies bool
+
+// Request ids sent by clients or proxies in front of the api are kept if they look harmless
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Query parameters and body fields with one of these names or name endings are redacted
+var (
+	accessLogSecretNames    = []string{"key", "auth", "authorization", "sig"}
+	accessLogSecretSuffixes = []string{"token", "secret", "password", "passwd", "apikey", "api_key", "signature"}
+)
+
+// Catches secrets in json bodies that were cut off at accessLogMaxBody and can't be decoded anymore
+var accessLogJSONSecretPattern = regexp.MustCompile(`(?i)("(?:[^"]*(?:token|secret|password|passwd|apikey|api_key|signature)|key|auth|authorization|sig)"\s*:\s*)"(?:[^"\\]|\\.)*"?`)
+
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id"`
+	Vhost      string    `json:"vhost"`
+	Host       string    `json:"host"`
+	ClientIP   string    `json:"client_ip"`
+	User       string    `json:"user,omitempty"`
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"`
+	Route      string    `json:"route,omitempty"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int       `json:"bytes"`
+	DurationMS float64   `json:"duration_ms"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	Body       string    `json:"body,omitempty"`
+	Errors     string    `json:"errors,omitempty"`
+}
+
+// accessLogInit applies the format of the access log from LOG_FORMAT and
+// whether request bodies are logged from LOG_REQUEST_BODIES
+func accessLogInit() {
+	accessLogFormat = config.LogFormat
+	accessLogBodies = config.LogRequestBodies
+}
+
+// accessLog tags every request with a request id and writes a line per request to the standard output
+func accessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		requestID := c.GetHeader(requestIDHeader)
+		if !requestIDPattern.MatchString(requestID) {
+			requestID = newRequestID()
+		}
+		c.Set("request_id", requestID)
+		c.Header(requestIDHeader, requestID)
+		var body *accessLogBody
+		if accessLogBodies && c.Request.Body != nil && loggableBody(c.ContentType()) {
+			body = &accessLogBody{ReadCloser: c.Request.Body}
+			c.Request.Body = body
+		}
+		// Handlers may replace the url, e.g. the cors proxy
+		uri := c.Request.URL.RequestURI()
+
+		c.Next()
+
+		entry := accessLogEntry{
+			Time:       start,
+			RequestID:  requestID,
+			Vhost:      requestVhost(c.Request),
+			Host:       c.Request.Host,
+			ClientIP:   clientIP(c.Request),
+			Method:     c.Request.Method,
+			URI:        redactURI(uri),
+			Route:      c.FullPath(),
+			Proto:      c.Request.Proto,
+			Status:     c.Writer.Status(),
+			Bytes:      c.Writer.Size(),
+			DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+			Referer:    redactURI(c.Request.Referer()),
+			UserAgent:  c.Request.UserAgent(),
+			Errors:     c.Errors.ByType(gin.ErrorTypePrivate).String(),
+		}
+		if entry.Bytes < 0 {
+			entry.Bytes = 0
+		}
+		if user, ok := c.Get("user"); ok {
+			entry.User, _ = user.(string)
+		}
+		if body != nil {
+			entry.Body = redactBody(c.ContentType(), body.captured)
+		}
+		// Paths can contain secrets of the configuration as well, e.g. the bot token in a webhook url
+		io.WriteString(redactingWriter{gin.DefaultWriter}, entry.format()+"\n")
+	}
+}
+
+// clientIP is the address of the client. Behind TRUSTED_PROXY_HOPS proxies that each append the address they were
+// connected from to X-Forwarded-For, like the Heroku router, it is the entry that many hops from the end.
+// The entries before it were sent by the client and can't be trusted.
+func clientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	hops := config.TrustedProxyHops
+	if hops == 0 {
+		return remote
+	}
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			forwarded = append(forwarded, strings.TrimSpace(hop))
+		}
+	}
+	// The request did not pass all proxies
+	if len(forwarded) < hops {
+		return remote
+	}
+	ip := net.ParseIP(forwarded[len(forwarded)-hops])
+	if ip == nil {
+		return remote
+	}
+	return ip.String()
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(id)
+}
+
+func (e accessLogEntry) format() string {
+	switch accessLogFormat {
+	case accessLogJSON:
+		line, err := json.Marshal(e)
+		if err != nil {
+			return `{"error":"could not encode access log entry"}`
+		}
+		return string(line)
+	case accessLogApache:
+		// The combined log format with the virtual host in front like apache's vhost_combined and the request id at the end
+		return e.Vhost + " " + e.ClientIP + " - " + apacheField(e.User) + " [" + e.Time.Format("02/Jan/2006:15:04:05 -0700") + "] " +
+			strconv.Quote(e.Method+" "+e.URI+" "+e.Proto) + " " + strconv.Itoa(e.Status) + " " + strconv.Itoa(e.Bytes) + " " +
+			strconv.Quote(apacheField(e.Referer)) + " " + strconv.Quote(apacheField(e.UserAgent)) + " " + e.RequestID
+	default:
+		line := "[ACCESS] " + e.Time.Format("2006/01/02 - 15:04:05") + " | " + strconv.Itoa(e.Status) + " | " +
+			strconv.FormatFloat(e.DurationMS, 'f', 3, 64) + "ms | " + e.ClientIP + " | " + e.Vhost + " | " +
+			e.Method + " " + strconv.Quote(e.URI) + " | " + e.RequestID
+		if e.Body != "" {
+			line += " | body " + strconv.Quote(e.Body)
+		}
+		if e.Errors != "" {
+			line += " | " + strings.TrimSpace(e.Errors)
+		}
+		return line
+	}
+}
+
+// apacheField is the value of a field in the apache format, where missing values are a dash
+func apacheField(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// accessLogBody keeps the beginning of a request body while the handler reads it
+type accessLogBody struct {
+	io.ReadCloser
+	captured []byte
+}
+
+func (b *accessLogBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if remaining := accessLogMaxBody - len(b.captured); remaining > 0 {
+		if remaining > n {
+			remaining = n
+		}
+		b.captured = append(b.captured, p[:remaining]...)
+	}
+	return n, err
+}
+
+// Only bodies that can be redacted are logged
+func loggableBody(contentType string) bool {
+	return contentType == gin.MIMEJSON || contentType == gin.MIMEPOSTForm
+}
+
+func isSecretName(name string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range accessLogSecretNames {
+		if name == secret {
+			return true
+		}
+	}
+	for _, suffix := range accessLogSecretSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactURI replaces the values of secret query parameters, keeping the order and encoding of the others
+func redactURI(uri string) string {
+	i := strings.IndexByte(uri, '?')
+	if i < 0 {
+		return uri
+	}
+	return uri[:i+1] + redactQuery(uri[i+1:])
+}
+
+func redactQuery(query string) string {
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		j := strings.IndexByte(param, '=')
+		if j < 0 {
+			continue
+		}
+		name := param[:j]
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if isSecretName(name) {
+			params[i] = param[:j+1] + "REDACTED"
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+func redactBody(contentType string, body []byte) string {
+	if contentType == gin.MIMEPOSTForm {
+		return redactQuery(string(body))
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		return accessLogJSONSecretPattern.ReplaceAllString(string(body), `${1}"REDACTED"`)
+	}
+	redacted, err := json.Marshal(redactJSON(decoded))
+	if err != nil {
+		return ""
+	}
+	return string(redacted)
+}
+
+func redactJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if isSecretName(key) {
+				v[key] = "REDACTED"
+			} else {
+				v[key] = redactJSON(field)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactJSON(v[i])
+		}
+	}
+	return value
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestClientIP(t *testing.T) {
+	previous := config
+	t.Cleanup(func() { config = previous })
+
+	tests := []struct {
+		hops      int
+		forwarded []string
+		want      string
+	}{
+		{0, nil, "10.0.0.1"},
+		{0, []string{"203.0.113.7"}, "10.0.0.1"},
+		{1, []string{"203.0.113.7"}, "203.0.113.7"},
+		// The client prepended a spoofed entry, the Heroku router appended the real one
+		{1, []string{"198.51.100.1, 203.0.113.7"}, "203.0.113.7"},
+		{1, []string{"198.51.100.1", "203.0.113.7"}, "203.0.113.7"},
+		{2, []string{"198.51.100.1, 203.0.113.7, 10.0.0.2"}, "203.0.113.7"},
+		{2, []string{"203.0.113.7"}, "10.0.0.1"},
+		{1, nil, "10.0.0.1"},
+		{1, []string{"not an ip"}, "10.0.0.1"},
+		{1, []string{"2001:db8::1"}, "2001:db8::1"},
+	}
+	for _, test := range tests {
+		config.TrustedProxyHops = test.hops
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		for _, header := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", header)
+		}
+		if got := clientIP(r); got != test.want {
+			t.Errorf("clientIP with %d hops and X-Forwarded-For %q = %q, want %q", test.hops, test.forwarded, got, test.want)
+		}
+	}
+}
+
+func TestRedactURI(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{"/mensa/today", "/mensa/today"},
+		{"/mensa/today?format=json", "/mensa/today?format=json"},
+		{"/quotes?token=abc&page=2", "/quotes?token=REDACTED&page=2"},
+		{"/x?api_key=abc&Access_Token=def&key=ghi&keyword=jkl", "/x?api_key=REDACTED&Access_Token=REDACTED&key=REDACTED&keyword=jkl"},
+		{"/x?sig=a%20b&q=a%20b", "/x?sig=REDACTED&q=a%20b"},
+		// Escaped names are recognized as well
+		{"/x?%74oken=abc", "/x?%74oken=REDACTED"},
+		{"/x?token&password=", "/x?token&password=REDACTED"},
+		{"/x?", "/x?"},
+	}
+	for _, test := range tests {
+		if got := redactURI(test.uri); got != test.want {
+			t.Errorf("redactURI(%q) = %q, want %q", test.uri, got, test.want)
+		}
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		want        string
+	}{
+		{gin.MIMEPOSTForm, "user=alice&password=hunter2", "user=alice&password=REDACTED"},
+		{gin.MIMEJSON, `{"user":"alice","password":"hunter2"}`, `{"password":"REDACTED","user":"alice"}`},
+		{gin.MIMEJSON, `{"auth":{"token":"abc"},"items":[{"clientSecret":"def","n":1}]}`, `{"auth":"REDACTED","items":[{"clientSecret":"REDACTED","n":1}]}`},
+		{gin.MIMEJSON, `[{"apiKey":"abc"}]`, `[{"apiKey":"REDACTED"}]`},
+		{gin.MIMEJSON, `"just a string"`, `"just a string"`},
+		// Bodies cut off at accessLogMaxBody can't be decoded anymore
+		{gin.MIMEJSON, `{"user":"alice","token":"abc","message":"hel`, `{"user":"alice","token":"REDACTED","message":"hel`},
+		{gin.MIMEJSON, `{"user":"alice","Password" : "hun\"ter`, `{"user":"alice","Password" : "REDACTED"`},
+	}
+	for _, test := range tests {
+		if got := redactBody(test.contentType, []byte(test.body)); got != test.want {
+			t.Errorf("redactBody(%q, %s) = %s, want %s", test.contentType, test.body, got, test.want)
+		}
+	}
+}
+
+func TestAccessLogRedactsSecrets(t *testing.T) {
+	previous, previousWriter := config, gin.DefaultWriter
+	t.Cleanup(func() { config, gin.DefaultWriter = previous, previousWriter })
+	config.TelegramToken = "123456:telegram-secret"
+	var log bytes.Buffer
+	gin.DefaultWriter = &log
+
+	router := gin.New()
+	router.Use(accessLog())
+	router.POST("/telegram/:token", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/telegram/123456:telegram-secret", nil))
+	if strings.Contains(log.String(), "telegram-secret") || !strings.Contains(log.String(), "/telegram/REDACTED") {
+		t.Errorf("access log is %q", log.String())
+	}
+}
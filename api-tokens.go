@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Scopes that can be granted to api tokens, "*" grants all of them
+var apiTokenScopes = []string{
+	"discord:send",
+	"telegram:send",
+	"matrix:send",
+	"quotes:write",
+	"tokens:admin",
+	"cors:log",
+	"links:write",
+	"metrics:read",
+}
+
+// Only this much of a request body is searched for a token
+const apiTokenMaxBodySize = 1 << 20
+
+type apiTokenAPIObject struct {
+	ID        int        `json:"id"`
+	Name      string     `json:"name" binding:"required"`
+	Scopes    []string   `json:"scopes" binding:"required"`
+	Token     string     `json:"token,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// apiTokenRoutes registers the admin endpoints to manage api tokens
+func apiTokenRoutes(router *gin.Engine) {
+	tokens := router.Group("/admin/tokens", requireScope("tokens:admin"))
+	tokens.GET("", listAPITokens)
+	tokens.POST("", issueAPIToken)
+	tokens.DELETE("/:id", revokeAPIToken)
+}
+
+// requireScope only lets requests pass that carry a valid token with the given scope.
+// Users authenticated by a jwt with the admin group have all scopes.
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get("user"); ok {
+			if !inGroup(c, "admin") {
+				unauthorized(c)
+				return
+			}
+			c.Next()
+			return
+		}
+		token := requestToken(c)
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+		scopes, err := lookupAPIToken(token)
+		if err != nil {
+			apiLog.Error("Error looking up api token: ", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			return
+		}
+		if scopes == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+			return
+		}
+		if !scopeAllowed(scopes, scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "token is missing the scope " + scope})
+			return
+		}
+		c.Set("scopes", scopes)
+		c.Next()
+	}
+}
+
+// requestToken looks for a token in the Authorization header, the query and the request body
+func requestToken(c *gin.Context) string {
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if token := c.Query("token"); token != "" {
+		return token
+	}
+	if c.Request.Body == nil || c.Request.Method == http.MethodGet {
+		return ""
+	}
+	// Read the body and put it back for the handler
+	body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, apiTokenMaxBodySize))
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	if strings.HasPrefix(c.ContentType(), gin.MIMEJSON) {
+		var bodyToken struct {
+			Token string `json:"token"`
+		}
+		_ = json.Unmarshal(body, &bodyToken)
+		return bodyToken.Token
+	}
+	token := c.PostForm("token")
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return token
+}
+
+// lookupAPIToken returns the scopes of a token or nil if the token is unknown or revoked.
+// The tokens configured in API_TOKENS have all scopes.
+func lookupAPIToken(token string) ([]string, error) {
+	if isValidAPIToken(token) {
+		return []string{"*"}, nil
+	}
+	var scopes []string
+	err := db.QueryRow(`SELECT scopes FROM api_tokens WHERE token_hash=$1 AND revoked_at IS NULL`, hashAPIToken(token)).Scan(pq.Array(&scopes))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if scopes == nil {
+		scopes = []string{}
+	}
+	return scopes, nil
+}
+
+// scopeAllowed checks if the scope is granted by one of the scopes, "*" and "prefix:*" act as wildcards
+func scopeAllowed(scopes []string, scope string) bool {
+	for _, granted := range scopes {
+		if granted == "*" || granted == scope {
+			return true
+		}
+		if strings.HasSuffix(granted, ":*") && strings.HasPrefix(scope, strings.TrimSuffix(granted, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+func hashAPIToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func isKnownAPITokenScope(scope string) bool {
+	if scope == "*" {
+		return true
+	}
+	for _, known := range apiTokenScopes {
+		if scope == known || (strings.HasSuffix(scope, ":*") && strings.HasPrefix(known, strings.TrimSuffix(scope, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+func listAPITokens(c *gin.Context) {
+	rows, err := db.Query(`SELECT id, name, scopes, created_at, revoked_at FROM api_tokens ORDER BY id`)
+	if err != nil {
+		apiLog.Error("Error listing api tokens: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	defer rows.Close()
+	tokens := []apiTokenAPIObject{}
+	for rows.Next() {
+		var token apiTokenAPIObject
+		if err := rows.Scan(&token.ID, &token.Name, pq.Array(&token.Scopes), &token.CreatedAt, &token.RevokedAt); err != nil {
+			apiLog.Error("Error scanning api token: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			return
+		}
+		tokens = append(tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		apiLog.Error("Error iterating api tokens: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tokens": tokens})
+}
+
+func issueAPIToken(c *gin.Context) {
+	var token apiTokenAPIObject
+	if err := c.ShouldBindJSON(&token); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, scope := range token.Scopes {
+		if !isKnownAPITokenScope(scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown scope " + scope})
+			return
+		}
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		apiLog.Error("Error generating api token: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	token.Token = "tsdr_" + hex.EncodeToString(secret)
+	err := db.QueryRow(`INSERT INTO api_tokens (name, token_hash, scopes) VALUES ($1, $2, $3) RETURNING id, created_at`,
+		token.Name, hashAPIToken(token.Token), pq.Array(token.Scopes)).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		apiLog.Error("Error saving api token: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	apiLog.Info("Issued api token " + strconv.Itoa(token.ID) + " (" + token.Name + ") with scopes " + strings.Join(token.Scopes, ", "))
+	// The token is only shown once, only its hash is stored
+	c.JSON(http.StatusCreated, token)
+}
+
+func revokeAPIToken(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid token id"})
+		return
+	}
+	res, err := db.Exec(`UPDATE api_tokens SET revoked_at=now() WHERE id=$1 AND revoked_at IS NULL`, id)
+	if err != nil {
+		apiLog.Error("Error revoking api token: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "token not found or already revoked"})
+		return
+	}
+	apiLog.Info("Revoked api token " + strconv.Itoa(id))
+	c.Status(http.StatusNoContent)
+}
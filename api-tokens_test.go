@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestScopeAllowed(t *testing.T) {
+	tests := []struct {
+		scopes  []string
+		scope   string
+		allowed bool
+	}{
+		{nil, "quotes:write", false},
+		{[]string{}, "quotes:write", false},
+		{[]string{"quotes:write"}, "quotes:write", true},
+		{[]string{"quotes:write"}, "quotes:read", false},
+		{[]string{"telegram:send", "quotes:write"}, "quotes:write", true},
+		{[]string{"*"}, "tokens:admin", true},
+		{[]string{"quotes:*"}, "quotes:write", true},
+		{[]string{"quotes:*"}, "tokens:admin", false},
+		// The wildcard only covers whole prefixes
+		{[]string{"quotes:*"}, "quotesx:write", false},
+		{[]string{"quotes*"}, "quotes:write", false},
+		{[]string{"quotes"}, "quotes:write", false},
+		{[]string{"Quotes:write"}, "quotes:write", false},
+	}
+	for _, test := range tests {
+		if got := scopeAllowed(test.scopes, test.scope); got != test.allowed {
+			t.Errorf("scopeAllowed(%q, %q) = %v, want %v", test.scopes, test.scope, got, test.allowed)
+		}
+	}
+}
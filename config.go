@@ -0,0 +1,502 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// appConfig is the whole configuration of the application. Every field is read from the environment variable in its
+// env tag, from the file named by the variable with a _FILE suffix (e.g. docker secrets) or from the same key in
+// lowercase in the yaml or toml file named by CONFIG_FILE, in this order of precedence.
+// Fields tagged secret are redacted when the configuration is printed, "password" only redacts the password of an url.
+type appConfig struct {
+	Mode             string        `env:"MODE"`
+	Port             string        `env:"PORT"`
+	TrustedProxyHops int           `env:"TRUSTED_PROXY_HOPS"`
+	ShutdownTimeout  time.Duration `env:"SHUTDOWN_TIMEOUT" default:"25s"`
+	LogFormat        string        `env:"LOG_FORMAT" default:"text"`
+	LogRequestBodies bool          `env:"LOG_REQUEST_BODIES"`
+
+	APIEnabled      bool   `env:"API_ENABLED" default:"true"`
+	CorsEnabled     bool   `env:"CORS_ENABLED" default:"true"`
+	InternalEnabled bool   `env:"INTERNAL_ENABLED" default:"true"`
+	Vhosts          string `env:"VHOSTS"`
+	DefaultVhost    string `env:"DEFAULT_VHOST"`
+
+	DatabaseURL         string `env:"DATABASE_URL" secret:"password"`
+	APITokens           string `env:"API_TOKENS" secret:"true"`
+	JWTHS256Secret      string `env:"JWT_HS256_SECRET" secret:"true"`
+	JWTEd25519PublicKey string `env:"JWT_ED25519_PUBLIC_KEY"`
+	JWTIssuer           string `env:"JWT_ISSUER"`
+	JWTAudience         string `env:"JWT_AUDIENCE"`
+
+	// The bots are enabled if all their required values are configured unless their enable flag says otherwise,
+	// except for the discord bot, which was replaced by github.com/tionis/glyph
+	TelegramEnabled     bool   `env:"TELEGRAM_ENABLED"`
+	TelegramToken       string `env:"TELEGRAM_TOKEN" secret:"true"`
+	TelegramChatAliases string `env:"TELEGRAM_CHAT_ALIASES"`
+	DiscordEnabled      bool   `env:"DISCORD_ENABLED"`
+	DiscordToken        string `env:"DISCORD_TOKEN" secret:"true"`
+	MatrixEnabled       bool   `env:"MATRIX_ENABLED"`
+	MatrixHomeserver    string `env:"MATRIX_HOMESERVER"`
+	MatrixAccessToken   string `env:"MATRIX_ACCESS_TOKEN" secret:"true"`
+	MatrixUserID        string `env:"MATRIX_USER_ID"`
+	UniPassauBotEnabled bool   `env:"UNIPASSAUBOT_ENABLED"`
+	UniPassauBotToken   string `env:"UNIPASSAUBOT_TOKEN" secret:"true"`
+
+	CorsAllowHosts        string        `env:"CORS_ALLOW_HOSTS"`
+	CorsDenyHosts         string        `env:"CORS_DENY_HOSTS"`
+	CorsCredentialOrigins string        `env:"CORS_CREDENTIAL_ORIGINS"`
+	CorsCacheSize         int           `env:"CORS_CACHE_SIZE"`
+	CorsCachePersist      bool          `env:"CORS_CACHE_PERSIST"`
+	CorsMaxRequestBody    int64         `env:"CORS_MAX_REQUEST_BODY" default:"10485760"`
+	CorsMaxResponseBody   int64         `env:"CORS_MAX_RESPONSE_BODY" default:"52428800"`
+	CorsDialTimeout       time.Duration `env:"CORS_DIAL_TIMEOUT" default:"10s"`
+	CorsHeaderTimeout     time.Duration `env:"CORS_HEADER_TIMEOUT" default:"30s"`
+	CorsTimeout           time.Duration `env:"CORS_TIMEOUT" default:"60s"`
+	CorsMaxPerHost        int           `env:"CORS_MAX_PER_HOST" default:"16"`
+	CorsLogRetention      time.Duration `env:"CORS_LOG_RETENTION" default:"720h"`
+
+	WikiLogURLTemplate     string `env:"WIKI_LOG_URL_TEMPLATE"`
+	WikiLogWeekURLTemplate string `env:"WIKI_LOG_WEEK_URL_TEMPLATE"`
+
+	// Where every configured value came from by environment variable name
+	sources map[string]string
+}
+
+var config appConfig
+
+// The routers that can be referenced by VHOSTS and DEFAULT_VHOST
+var configRouters = []string{"api", "cors", "internal"}
+
+// loadConfig reads the configuration from CONFIG_FILE and the environment, all problems are returned together
+func loadConfig() (appConfig, error) {
+	c := appConfig{sources: make(map[string]string)}
+	var problems []string
+	layers := []func(name string) (value string, source string, err error){environmentConfig}
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		file, err := readConfigFile(path, c.names())
+		if err != nil {
+			return c, err
+		}
+		layers = append(layers, file)
+	}
+
+	v := reflect.ValueOf(&c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		value, source := field.Tag.Get("default"), ""
+		for _, layer := range layers {
+			configured, from, err := layer(name)
+			if err != nil {
+				problems = append(problems, err.Error())
+				break
+			}
+			if from != "" {
+				value, source = configured, from
+				break
+			}
+		}
+		if err := setConfigField(v.Field(i), value); err != nil {
+			if source == "" {
+				source = "default"
+			}
+			problems = append(problems, name+" ("+source+"): "+err.Error())
+			continue
+		}
+		if source != "" {
+			c.sources[name] = source
+		}
+	}
+	problems = append(problems, c.validate()...)
+	if len(problems) > 0 {
+		return c, errors.New("invalid configuration:\n - " + strings.Join(problems, "\n - "))
+	}
+	return c, nil
+}
+
+// environmentConfig looks up a value in the environment, empty variables count as unset
+func environmentConfig(name string) (string, string, error) {
+	value := os.Getenv(name)
+	path := os.Getenv(name + "_FILE")
+	switch {
+	case value != "" && path != "":
+		return "", "", errors.New("only one of " + name + " and " + name + "_FILE may be set")
+	case path != "":
+		value, err := readConfigSecret(path)
+		if err != nil {
+			return "", "", errors.New(name + "_FILE: " + err.Error())
+		}
+		return value, name + "_FILE " + path, nil
+	case value != "":
+		return value, "environment", nil
+	}
+	return "", "", nil
+}
+
+// readConfigFile reads a file of lowercase names and their values, lists are joined with commas.
+// Files ending in .toml are read as toml, all others as yaml.
+func readConfigFile(path string, names map[string]bool) (func(name string) (string, string, error), error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("error reading CONFIG_FILE: " + err.Error())
+	}
+	var raw map[string]interface{}
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = toml.Unmarshal(content, &raw)
+	} else {
+		err = yaml.Unmarshal(content, &raw)
+	}
+	if err != nil {
+		return nil, errors.New("error parsing CONFIG_FILE " + path + ": " + err.Error())
+	}
+	values := make(map[string]string)
+	var problems []string
+	for key, value := range raw {
+		name := strings.ToUpper(key)
+		if !names[name] && !names[strings.TrimSuffix(name, "_FILE")] {
+			problems = append(problems, "unknown key "+key)
+			continue
+		}
+		switch v := value.(type) {
+		case nil:
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[name] = strings.Join(items, ",")
+		case map[interface{}]interface{}, map[string]interface{}:
+			problems = append(problems, key+" has to be a value or a list")
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, errors.New("invalid CONFIG_FILE " + path + ":\n - " + strings.Join(problems, "\n - "))
+	}
+	return func(name string) (string, string, error) {
+		value, hasValue := values[name]
+		path, hasPath := values[name+"_FILE"]
+		switch {
+		case hasValue && hasPath:
+			return "", "", errors.New("only one of " + strings.ToLower(name) + " and " + strings.ToLower(name) + "_file may be set in CONFIG_FILE")
+		case hasPath:
+			value, err := readConfigSecret(path)
+			if err != nil {
+				return "", "", errors.New(strings.ToLower(name) + "_file: " + err.Error())
+			}
+			return value, "CONFIG_FILE " + strings.ToLower(name) + "_file " + path, nil
+		case hasValue:
+			return value, "CONFIG_FILE", nil
+		}
+		return "", "", nil
+	}, nil
+}
+
+// readConfigSecret reads a value from a file without the trailing newline most editors add
+func readConfigSecret(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// setConfigField parses a value into a field, negative numbers and durations are never valid
+func setConfigField(field reflect.Value, value string) error {
+	value = strings.TrimSpace(value)
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(value)
+	case bool:
+		if value == "" {
+			field.SetBool(false)
+			return nil
+		}
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("has to be true or false, not " + strconv.Quote(value))
+		}
+		field.SetBool(parsed)
+	case time.Duration:
+		if value == "" {
+			field.SetInt(0)
+			return nil
+		}
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			return errors.New("has to be a duration like 30s or 1h, not " + strconv.Quote(value))
+		}
+		field.SetInt(int64(parsed))
+	case int, int64:
+		if value == "" {
+			field.SetInt(0)
+			return nil
+		}
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			return errors.New("has to be a positive number, not " + strconv.Quote(value))
+		}
+		field.SetInt(parsed)
+	default:
+		return errors.New("unsupported type " + field.Type().String())
+	}
+	return nil
+}
+
+// validate checks the values that depend on each other and enables the bots that have a token
+func (c *appConfig) validate() []string {
+	var problems []string
+	switch strings.ToLower(c.Mode) {
+	case "", "production", "debug":
+	default:
+		problems = append(problems, "MODE has to be production or debug, not "+strconv.Quote(c.Mode))
+	}
+	if c.Port != "" {
+		if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+			problems = append(problems, "PORT has to be a port number, not "+strconv.Quote(c.Port))
+		}
+	}
+	c.LogFormat = strings.ToLower(c.LogFormat)
+	switch c.LogFormat {
+	case accessLogText, accessLogJSON, accessLogApache:
+	default:
+		problems = append(problems, "LOG_FORMAT has to be text, json or apache, not "+strconv.Quote(c.LogFormat))
+	}
+	if c.DatabaseURL == "" {
+		problems = append(problems, "DATABASE_URL is required")
+	}
+	// Without them, tokens the issuer made for other services would be accepted as well
+	if c.JWTHS256Secret != "" || c.JWTEd25519PublicKey != "" {
+		for _, name := range []string{"JWT_ISSUER", "JWT_AUDIENCE"} {
+			if c.value(name) == "" {
+				problems = append(problems, name+" is required when a JWT key is configured")
+			}
+		}
+	}
+	// The cleanup would delete every entry right after it was written
+	if c.CorsLogRetention <= 0 {
+		problems = append(problems, "CORS_LOG_RETENTION has to be positive, not "+c.CorsLogRetention.String())
+	}
+
+	for _, vhost := range strings.Split(c.Vhosts, ",") {
+		if vhost = strings.TrimSpace(vhost); vhost == "" {
+			continue
+		}
+		parts := strings.SplitN(vhost, "=", 2)
+		if len(parts) != 2 || normalizeHost(parts[0]) == "" {
+			problems = append(problems, "VHOSTS entry "+strconv.Quote(vhost)+" has to be host=router")
+			continue
+		}
+		if problem := c.checkRouter(strings.TrimSpace(parts[1])); problem != "" {
+			problems = append(problems, "VHOSTS entry "+strconv.Quote(vhost)+" "+problem)
+		}
+	}
+	if c.DefaultVhost != "" {
+		if problem := c.checkRouter(c.DefaultVhost); problem != "" {
+			problems = append(problems, "DEFAULT_VHOST "+problem)
+		}
+	}
+
+	bots := []struct {
+		enabled  *bool
+		flag     string
+		required []string
+		// Whether the bot is started when its flag is not set
+		byDefault bool
+	}{
+		{&c.TelegramEnabled, "TELEGRAM_ENABLED", []string{"TELEGRAM_TOKEN"}, true},
+		{&c.DiscordEnabled, "DISCORD_ENABLED", []string{"DISCORD_TOKEN"}, false},
+		{&c.MatrixEnabled, "MATRIX_ENABLED", []string{"MATRIX_ACCESS_TOKEN", "MATRIX_HOMESERVER"}, true},
+		{&c.UniPassauBotEnabled, "UNIPASSAUBOT_ENABLED", []string{"UNIPASSAUBOT_TOKEN"}, true},
+	}
+	for _, bot := range bots {
+		var missing []string
+		for _, name := range bot.required {
+			if c.value(name) == "" {
+				missing = append(missing, name)
+			}
+		}
+		// A partly configured bot is only started when asked to, so the missing values are reported
+		if !c.isSet(bot.flag) {
+			*bot.enabled = bot.byDefault && len(missing) == 0
+		}
+		if *bot.enabled && len(missing) > 0 {
+			problems = append(problems, bot.flag+" is true but "+strings.Join(missing, " and ")+" is not set")
+		}
+	}
+	return problems
+}
+
+// checkRouter describes why a router can't be referenced or returns an empty string
+func (c *appConfig) checkRouter(name string) string {
+	for _, router := range configRouters {
+		if router == name {
+			if !c.routerEnabled(name) {
+				return "references the disabled " + name + " router"
+			}
+			return ""
+		}
+	}
+	return "references the unknown router " + strconv.Quote(name) + ", has to be one of " + strings.Join(configRouters, ", ")
+}
+
+func (c *appConfig) routerEnabled(name string) bool {
+	switch name {
+	case "api":
+		return c.APIEnabled
+	case "cors":
+		return c.CorsEnabled
+	case "internal":
+		return c.InternalEnabled
+	}
+	return false
+}
+
+// isSet reports whether a value was configured instead of using the default
+func (c *appConfig) isSet(name string) bool {
+	_, ok := c.sources[name]
+	return ok
+}
+
+// value returns the string field configured by an environment variable name
+func (c *appConfig) value(name string) string {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("env") == name {
+			return v.Field(i).String()
+		}
+	}
+	return ""
+}
+
+// names returns the environment variable names of all fields
+func (c *appConfig) names() map[string]bool {
+	names := make(map[string]bool)
+	t := reflect.TypeOf(*c)
+	for i := 0; i < t.NumField(); i++ {
+		if name := t.Field(i).Tag.Get("env"); name != "" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// print writes the configuration as yaml that can be used as CONFIG_FILE, secrets are redacted
+// and a comment tells where each value came from
+func (c *appConfig) print(w io.Writer) {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		var value interface{}
+		switch configured := v.Field(i).Interface().(type) {
+		case time.Duration:
+			value = configured.String()
+		case string:
+			value = redactConfigValue(configured, field.Tag.Get("secret"))
+		default:
+			value = configured
+		}
+		encoded, err := yaml.Marshal(value)
+		if err != nil {
+			encoded = []byte(`""`)
+		}
+		source := c.sources[name]
+		if source == "" {
+			source = "default"
+		}
+		fmt.Fprintf(w, "%s: %s # %s\n", strings.ToLower(name), strings.TrimSpace(string(encoded)), source)
+	}
+}
+
+func redactConfigValue(value string, secret string) string {
+	if value == "" {
+		return value
+	}
+	switch secret {
+	case "true":
+		return "REDACTED"
+	case "password":
+		// Connection strings like "host=... password=..." are redacted completely
+		parsed, err := url.Parse(value)
+		if err != nil || parsed.Scheme == "" {
+			return "REDACTED"
+		}
+		if _, ok := parsed.User.Password(); ok {
+			parsed.User = url.UserPassword(parsed.User.Username(), "REDACTED")
+		}
+		return parsed.String()
+	}
+	return value
+}
+
+// Secrets shorter than this are not redacted from texts, they would match all over the place
+const configMinRedactedLength = 8
+
+// redact replaces the values of all secrets in a text, e.g. a bot token in the url of an error.
+// Lists like API_TOKENS are redacted item by item.
+func (c *appConfig) redact(text string) string {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		secret := t.Field(i).Tag.Get("secret")
+		if secret == "" || v.Field(i).Kind() != reflect.String {
+			continue
+		}
+		value := v.Field(i).String()
+		if secret == "password" {
+			parsed, err := url.Parse(value)
+			if err != nil {
+				continue
+			}
+			value, _ = parsed.User.Password()
+		}
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if len(item) < configMinRedactedLength {
+				continue
+			}
+			for _, encoded := range []string{item, url.PathEscape(item), url.QueryEscape(item)} {
+				text = strings.Replace(text, encoded, "REDACTED", -1)
+			}
+		}
+	}
+	return text
+}
+
+// redactingWriter removes the secrets of the configuration from everything written to it
+type redactingWriter struct {
+	io.Writer
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.Writer, config.redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useEnvironment replaces all configuration variables with env for the test
+func useEnvironment(t *testing.T, env map[string]string) {
+	names := []string{"CONFIG_FILE"}
+	for name := range (&appConfig{}).names() {
+		names = append(names, name, name+"_FILE")
+	}
+	for _, name := range names {
+		if previous, ok := os.LookupEnv(name); ok {
+			name := name
+			t.Cleanup(func() { os.Setenv(name, previous) })
+		} else {
+			name := name
+			t.Cleanup(func() { os.Unsetenv(name) })
+		}
+		os.Unsetenv(name)
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+	}
+}
+
+func TestLoadConfigValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		problems []string
+	}{
+		{"minimal", map[string]string{}, nil},
+		{"without database", map[string]string{"DATABASE_URL": ""}, []string{"DATABASE_URL is required"}},
+		{"debug mode", map[string]string{"MODE": "Debug"}, nil},
+		{"unknown mode", map[string]string{"MODE": "staging"}, []string{`MODE has to be production or debug, not "staging"`}},
+		{"port", map[string]string{"PORT": "8080"}, nil},
+		{"invalid port", map[string]string{"PORT": "70000"}, []string{`PORT has to be a port number, not "70000"`}},
+		{"log format", map[string]string{"LOG_FORMAT": "JSON"}, nil},
+		{"unknown log format", map[string]string{"LOG_FORMAT": "xml"}, []string{"LOG_FORMAT has to be text, json or apache"}},
+		{"invalid bool", map[string]string{"API_ENABLED": "yes"}, []string{`API_ENABLED (environment): has to be true or false, not "yes"`}},
+		{"negative duration", map[string]string{"CORS_TIMEOUT": "-1s"}, []string{"CORS_TIMEOUT (environment): has to be a duration"}},
+		{"negative number", map[string]string{"CORS_MAX_PER_HOST": "-1"}, []string{"CORS_MAX_PER_HOST (environment): has to be a positive number"}},
+		{"zero log retention", map[string]string{"CORS_LOG_RETENTION": "0"}, []string{"CORS_LOG_RETENTION has to be positive, not 0s"}},
+		{"vhosts", map[string]string{"VHOSTS": "api.example.com=api, cors.example.com=cors", "DEFAULT_VHOST": "internal"}, nil},
+		{"invalid vhost", map[string]string{"VHOSTS": "api.example.com"}, []string{`VHOSTS entry "api.example.com" has to be host=router`}},
+		{"unknown router", map[string]string{"VHOSTS": "api.example.com=web"}, []string{`references the unknown router "web"`}},
+		{"disabled router", map[string]string{"API_ENABLED": "false", "DEFAULT_VHOST": "api"}, []string{"DEFAULT_VHOST references the disabled api router"}},
+		{"telegram without token", map[string]string{"TELEGRAM_ENABLED": "true"}, []string{"TELEGRAM_ENABLED is true but TELEGRAM_TOKEN is not set"}},
+		{"matrix without homeserver", map[string]string{"MATRIX_ACCESS_TOKEN": "matrix-token"}, nil},
+		{"matrix without token", map[string]string{"MATRIX_ENABLED": "true", "MATRIX_HOMESERVER": "https://matrix.org"}, []string{"MATRIX_ENABLED is true but MATRIX_ACCESS_TOKEN is not set"}},
+		{"jwt", map[string]string{"JWT_HS256_SECRET": "secret", "JWT_ISSUER": "issuer", "JWT_AUDIENCE": "audience"}, nil},
+		{"jwt without issuer", map[string]string{"JWT_HS256_SECRET": "secret"}, []string{"JWT_ISSUER is required", "JWT_AUDIENCE is required"}},
+		{"value and file", map[string]string{"DATABASE_URL_FILE": "/run/secrets/database_url"}, []string{"only one of DATABASE_URL and DATABASE_URL_FILE may be set"}},
+		{"all problems together", map[string]string{"MODE": "staging", "PORT": "http"}, []string{"MODE has to be", "PORT has to be"}},
+	}
+	for _, test := range tests {
+		env := map[string]string{"DATABASE_URL": "postgres://localhost/tsdr"}
+		for name, value := range test.env {
+			env[name] = value
+		}
+		useEnvironment(t, env)
+		_, err := loadConfig()
+		if len(test.problems) == 0 {
+			if err != nil {
+				t.Errorf("%s: loadConfig failed: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: loadConfig succeeded, want %q", test.name, test.problems)
+			continue
+		}
+		for _, problem := range test.problems {
+			if !strings.Contains(err.Error(), problem) {
+				t.Errorf("%s: loadConfig failed with %q, want %q", test.name, err, problem)
+			}
+		}
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	useEnvironment(t, map[string]string{"DATABASE_URL": "postgres://localhost/tsdr", "TELEGRAM_TOKEN": "telegram-token", "MATRIX_ACCESS_TOKEN": "matrix-token"})
+	c, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.CorsLogRetention != 720*time.Hour || !c.APIEnabled || c.LogFormat != accessLogText {
+		t.Errorf("defaults are not applied: %+v", c)
+	}
+	// Bots are enabled once all their required values are set, except for the discord bot
+	if !c.TelegramEnabled || c.MatrixEnabled || c.DiscordEnabled {
+		t.Errorf("bots enabled: telegram %v, matrix %v, discord %v, want only telegram", c.TelegramEnabled, c.MatrixEnabled, c.DiscordEnabled)
+	}
+	if c.sources["TELEGRAM_TOKEN"] != "environment" || c.sources["CORS_LOG_RETENTION"] != "" {
+		t.Errorf("sources are %v", c.sources)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	secret := filepath.Join(dir, "database_url")
+	if err := ioutil.WriteFile(secret, []byte("postgres://localhost/tsdr\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "config.yaml")
+	content := "database_url_file: " + secret + "\nport: 8080\nlog_format: apache\nvhosts:\n  - api.example.com=api\n  - cors.example.com=cors\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The environment takes precedence over the file
+	useEnvironment(t, map[string]string{"CONFIG_FILE": file, "LOG_FORMAT": "json"})
+	c, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.DatabaseURL != "postgres://localhost/tsdr" || c.Port != "8080" || c.LogFormat != accessLogJSON {
+		t.Errorf("config is %+v", c)
+	}
+	if c.Vhosts != "api.example.com=api,cors.example.com=cors" {
+		t.Errorf("VHOSTS list was joined to %q", c.Vhosts)
+	}
+	if c.sources["DATABASE_URL"] != "CONFIG_FILE database_url_file "+secret || c.sources["LOG_FORMAT"] != "environment" {
+		t.Errorf("sources are %v", c.sources)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("database_url: postgres://localhost/tsdr\nunknown_setting: 1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "unknown_setting") {
+		t.Errorf("loadConfig with an unknown key returned %v", err)
+	}
+	// TOML in a YAML file
+	if err := ioutil.WriteFile(file, []byte("[server]\nport = 8080\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "error parsing CONFIG_FILE") {
+		t.Errorf("loadConfig with TOML in a YAML file returned %v", err)
+	}
+}
+
+func TestLoadConfigTOMLFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	file := filepath.Join(dir, "config.toml")
+	content := "database_url = \"postgres://localhost/tsdr\"\nport = 8080\ncors_timeout = \"30s\"\nvhosts = [\"api.example.com=api\", \"cors.example.com=cors\"]\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	useEnvironment(t, map[string]string{"CONFIG_FILE": file})
+	c, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.DatabaseURL != "postgres://localhost/tsdr" || c.Port != "8080" || c.CorsTimeout != 30*time.Second {
+		t.Errorf("config is %+v", c)
+	}
+	if c.Vhosts != "api.example.com=api,cors.example.com=cors" {
+		t.Errorf("VHOSTS list was joined to %q", c.Vhosts)
+	}
+
+	tests := []struct {
+		content string
+		problem string
+	}{
+		{"database_url = \"postgres://localhost/tsdr\"\n[vhosts]\napi = \"api.example.com\"\n", "vhosts has to be a value or a list"},
+		{"database_url: postgres://localhost/tsdr\n", "error parsing CONFIG_FILE"},
+	}
+	for _, test := range tests {
+		if err := ioutil.WriteFile(file, []byte(test.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), test.problem) {
+			t.Errorf("loadConfig with %q returned %v, want %q", test.content, err, test.problem)
+		}
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Longest freshness lifetime guessed from Last-Modified for responses without explicit expiry
+const corsCacheMaxHeuristicLifetime = time.Hour
+
+// Status codes that may be stored, see RFC 7231 section 6.1
+var corsCacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// corsCache is nil if caching is disabled
+var corsCache *corsResponseCache
+
+type corsCacheEntry struct {
+	key          string
+	status       int
+	header       http.Header
+	body         []byte
+	vary         map[string]string
+	stored       time.Time
+	expires      time.Time
+	etag         string
+	lastModified string
+}
+
+func (e *corsCacheEntry) size() int {
+	size := len(e.key) + len(e.body)
+	for name, values := range e.header {
+		size += len(name)
+		for _, value := range values {
+			size += len(value)
+		}
+	}
+	return size
+}
+
+// corsResponseCache is a size bounded lru cache of upstream responses
+type corsResponseCache struct {
+	mu           sync.Mutex
+	maxBytes     int
+	maxEntrySize int
+	bytes        int
+	lru          *list.List
+	entries      map[string]*list.Element
+	persist      bool
+}
+
+// corsCacheInit enables the cache if CORS_CACHE_SIZE (in bytes) is set,
+// CORS_CACHE_PERSIST=true additionally stores the entries in postgres and loads them on startup
+func corsCacheInit() {
+	size := config.CorsCacheSize
+	if size == 0 {
+		return
+	}
+	corsCache = &corsResponseCache{
+		maxBytes:     size,
+		maxEntrySize: size / 8,
+		lru:          list.New(),
+		entries:      make(map[string]*list.Element),
+		persist:      config.CorsCachePersist,
+	}
+	if corsCache.persist {
+		if err := corsCache.loadPersisted(); err != nil {
+			corsLog.Error("Error loading persisted cors cache entries: ", err)
+		}
+		go func() {
+			for {
+				_, err := db.Exec(`DELETE FROM cors_cache WHERE expires_at < $1`, time.Now().Add(-24*time.Hour))
+				if err != nil {
+					corsLog.Error("Error deleting expired cors cache entries: ", err)
+				}
+				time.Sleep(time.Hour)
+			}
+		}()
+	}
+	corsLog.Info("CORS proxy cache enabled with " + strconv.Itoa(size) + " bytes")
+}
+
+// RoundTrip serves GET requests from the cache and stores cacheable upstream responses
+func (cache *corsResponseCache) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !corsRequestCacheable(r) {
+		return corsUpstreamRoundTrip(r)
+	}
+	key := r.URL.String()
+	entry := cache.get(key)
+	if entry != nil && !entry.matchesVary(r) {
+		entry = nil
+	}
+	now := time.Now()
+	requestCacheControl := parseCacheControl(r.Header.Get("Cache-Control"))
+	_, noCache := requestCacheControl["no-cache"]
+	if entry != nil && !noCache && now.Before(entry.expires) {
+		return entry.response(r, "HIT"), nil
+	}
+
+	// Ask the upstream, conditionally if there is an entry to revalidate
+	upstreamRequest := r.Clone(r.Context())
+	for _, name := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+		upstreamRequest.Header.Del(name)
+	}
+	if entry != nil {
+		if entry.etag != "" {
+			upstreamRequest.Header.Set("If-None-Match", entry.etag)
+		}
+		if entry.lastModified != "" {
+			upstreamRequest.Header.Set("If-Modified-Since", entry.lastModified)
+		}
+	}
+	resp, err := corsUpstreamRoundTrip(upstreamRequest)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil && resp.StatusCode == http.StatusNotModified {
+		_ = resp.Body.Close()
+		revalidated := entry.revalidated(resp, now)
+		cache.set(revalidated)
+		return revalidated.response(r, "REVALIDATED"), nil
+	}
+	if !corsResponseStorable(resp) {
+		return resp, nil
+	}
+	body, complete, err := readAtMost(resp.Body, cache.maxEntrySize)
+	if err != nil {
+		_ = resp.Body.Close()
+		return nil, err
+	}
+	if !complete {
+		// Too large for the cache, hand out the buffered part and the rest of the stream
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	_ = resp.Body.Close()
+	entry = newCorsCacheEntry(key, r, resp, body, now)
+	cache.set(entry)
+	return entry.response(r, "MISS"), nil
+}
+
+// get looks an entry up in memory only, the persisted entries were loaded on startup
+func (cache *corsResponseCache) get(key string) *corsCacheEntry {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if element, ok := cache.entries[key]; ok {
+		cache.lru.MoveToFront(element)
+		return element.Value.(*corsCacheEntry)
+	}
+	return nil
+}
+
+func (cache *corsResponseCache) set(entry *corsCacheEntry) {
+	cache.add(entry)
+	if cache.persist {
+		go saveCorsCacheEntry(entry)
+	}
+}
+
+// add puts an entry into the memory cache and evicts the least recently used entries if needed
+func (cache *corsResponseCache) add(entry *corsCacheEntry) {
+	if entry.size() > cache.maxEntrySize {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if element, ok := cache.entries[entry.key]; ok {
+		cache.bytes -= element.Value.(*corsCacheEntry).size()
+		cache.lru.Remove(element)
+	}
+	cache.entries[entry.key] = cache.lru.PushFront(entry)
+	cache.bytes += entry.size()
+	for cache.bytes > cache.maxBytes {
+		oldest := cache.lru.Back()
+		evicted := oldest.Value.(*corsCacheEntry)
+		cache.lru.Remove(oldest)
+		delete(cache.entries, evicted.key)
+		cache.bytes -= evicted.size()
+	}
+}
+
+// corsRequestCacheable excludes requests whose responses may be personalized or aren't plain downloads
+func corsRequestCacheable(r *http.Request) bool {
+	if r.Method != http.MethodGet || isEventStreamRequest(r) {
+		return false
+	}
+	for _, name := range []string{"Authorization", "Cookie", "Range", "Upgrade"} {
+		if r.Header.Get(name) != "" {
+			return false
+		}
+	}
+	_, noStore := parseCacheControl(r.Header.Get("Cache-Control"))["no-store"]
+	return !noStore
+}
+
+func corsResponseStorable(resp *http.Response) bool {
+	if !corsCacheableStatus[resp.StatusCode] || resp.Header.Get("Set-Cookie") != "" || resp.Header.Get("Vary") == "*" {
+		return false
+	}
+	// Streams must not be buffered
+	if isEventStreamResponse(resp) {
+		return false
+	}
+	cacheControl := parseCacheControl(resp.Header.Get("Cache-Control"))
+	if _, ok := cacheControl["no-store"]; ok {
+		return false
+	}
+	if _, ok := cacheControl["private"]; ok {
+		return false
+	}
+	return corsFreshnessLifetime(resp.Header, time.Now()) > 0 || resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+// corsFreshnessLifetime calculates how long a response stays fresh, see RFC 7234 section 4.2
+func corsFreshnessLifetime(header http.Header, now time.Time) time.Duration {
+	cacheControl := parseCacheControl(header.Get("Cache-Control"))
+	if _, ok := cacheControl["no-cache"]; ok {
+		return 0
+	}
+	var lifetime time.Duration
+	if maxAge, ok := cacheControl["s-maxage"]; ok {
+		seconds, _ := strconv.Atoi(maxAge)
+		lifetime = time.Duration(seconds) * time.Second
+	} else if maxAge, ok := cacheControl["max-age"]; ok {
+		seconds, _ := strconv.Atoi(maxAge)
+		lifetime = time.Duration(seconds) * time.Second
+	} else if expires := header.Get("Expires"); expires != "" {
+		expiresTime, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		lifetime = expiresTime.Sub(date)
+	} else if lastModified, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		lifetime = now.Sub(lastModified) / 10
+		if lifetime > corsCacheMaxHeuristicLifetime {
+			lifetime = corsCacheMaxHeuristicLifetime
+		}
+	}
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil {
+		lifetime -= time.Duration(age) * time.Second
+	}
+	if lifetime < 0 {
+		return 0
+	}
+	return lifetime
+}
+
+func parseCacheControl(header string) map[string]string {
+	directives := make(map[string]string)
+	for _, directive := range strings.Split(header, ",") {
+		directive = strings.TrimSpace(directive)
+		if directive == "" {
+			continue
+		}
+		parts := strings.SplitN(directive, "=", 2)
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if len(parts) == 2 {
+			directives[name] = strings.Trim(strings.TrimSpace(parts[1]), `"`)
+		} else {
+			directives[name] = ""
+		}
+	}
+	return directives
+}
+
+// readAtMost reads up to limit bytes and reports whether the reader was exhausted
+func readAtMost(r io.Reader, limit int) ([]byte, bool, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(body) > limit {
+		return body, false, nil
+	}
+	return body, true, nil
+}
+
+func newCorsCacheEntry(key string, r *http.Request, resp *http.Response, body []byte, now time.Time) *corsCacheEntry {
+	entry := &corsCacheEntry{
+		key:          key,
+		status:       resp.StatusCode,
+		header:       resp.Header.Clone(),
+		body:         body,
+		vary:         make(map[string]string),
+		stored:       now,
+		expires:      now.Add(corsFreshnessLifetime(resp.Header, now)),
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}
+	for _, vary := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(vary, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" {
+				entry.vary[name] = r.Header.Get(name)
+			}
+		}
+	}
+	return entry
+}
+
+func (e *corsCacheEntry) matchesVary(r *http.Request) bool {
+	for name, value := range e.vary {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// revalidated returns a copy of the entry updated with the headers of a 304 response
+func (e *corsCacheEntry) revalidated(resp *http.Response, now time.Time) *corsCacheEntry {
+	updated := *e
+	updated.header = e.header.Clone()
+	for _, name := range []string{"Cache-Control", "Date", "Expires", "ETag", "Last-Modified", "Vary"} {
+		if values := resp.Header.Values(name); len(values) > 0 {
+			updated.header[name] = values
+		}
+	}
+	updated.header.Del("Age")
+	updated.stored = now
+	updated.expires = now.Add(corsFreshnessLifetime(updated.header, now))
+	updated.etag = updated.header.Get("ETag")
+	updated.lastModified = updated.header.Get("Last-Modified")
+	return &updated
+}
+
+// response builds a response from the entry, a 304 if the request's conditions match
+func (e *corsCacheEntry) response(r *http.Request, cacheStatus string) *http.Response {
+	header := e.header.Clone()
+	header.Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+	header.Set("X-Cache", cacheStatus)
+	status := e.status
+	body := e.body
+	if e.status == http.StatusOK && e.notModifiedFor(r) {
+		status = http.StatusNotModified
+		body = nil
+		header.Del("Content-Length")
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}
+}
+
+// notModifiedFor evaluates If-None-Match and If-Modified-Since of the request, see RFC 7232 section 6
+func (e *corsCacheEntry) notModifiedFor(r *http.Request) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if e.etag == "" {
+			return false
+		}
+		for _, etag := range strings.Split(ifNoneMatch, ",") {
+			etag = strings.TrimSpace(etag)
+			if etag == "*" || strings.TrimPrefix(etag, "W/") == strings.TrimPrefix(e.etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" && e.lastModified != "" {
+		since, err := http.ParseTime(ifModifiedSince)
+		if err != nil {
+			return false
+		}
+		lastModified, err := http.ParseTime(e.lastModified)
+		return err == nil && !lastModified.After(since)
+	}
+	return false
+}
+
+// loadPersisted fills the memory cache with the most recently stored entries in postgres that fit into it
+func (cache *corsResponseCache) loadPersisted() error {
+	rows, err := db.Query(`SELECT key, status, header, body, vary, stored_at, expires_at, etag, last_modified FROM cors_cache ORDER BY stored_at DESC`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var entries []*corsCacheEntry
+	size := 0
+	for rows.Next() {
+		var entry corsCacheEntry
+		var header, vary string
+		err := rows.Scan(&entry.key, &entry.status, &header, &entry.body, &vary, &entry.stored, &entry.expires, &entry.etag, &entry.lastModified)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(header), &entry.header); err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(vary), &entry.vary); err != nil {
+			return err
+		}
+		if entry.size() > cache.maxEntrySize {
+			continue
+		}
+		if size+entry.size() > cache.maxBytes {
+			break
+		}
+		size += entry.size()
+		entries = append(entries, &entry)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// The oldest first, so the most recent entries end up in front of the lru list
+	for i := len(entries) - 1; i >= 0; i-- {
+		cache.add(entries[i])
+	}
+	corsLog.Info("Loaded " + strconv.Itoa(len(entries)) + " persisted cors cache entries")
+	return nil
+}
+
+func saveCorsCacheEntry(entry *corsCacheEntry) {
+	header, _ := json.Marshal(entry.header)
+	vary, _ := json.Marshal(entry.vary)
+	_, err := db.Exec(`INSERT INTO cors_cache (key, status, header, body, vary, stored_at, expires_at, etag, last_modified) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (key) DO UPDATE SET status=$2, header=$3, body=$4, vary=$5, stored_at=$6, expires_at=$7, etag=$8, last_modified=$9`,
+		entry.key, entry.status, string(header), entry.body, string(vary), entry.stored, entry.expires, entry.etag, entry.lastModified)
+	if err != nil {
+		corsLog.Error("Error saving cors cache entry: ", err)
+	}
+}
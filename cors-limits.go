@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errCorsRequestTooLarge  = errors.New("request body exceeds the limit")
+	errCorsResponseTooLarge = errors.New("response body exceeds the limit")
+	errCorsHostBusy         = errors.New("too many concurrent requests to the target host")
+)
+
+type corsProxyLimits struct {
+	maxRequestBody  int64
+	maxResponseBody int64
+	dialTimeout     time.Duration
+	headerTimeout   time.Duration
+	totalTimeout    time.Duration
+	maxPerHost      int
+}
+
+// Limits of the proxy, a value of 0 disables the respective limit
+var corsLimits corsProxyLimits
+
+// corsLimitsInit takes the limits from the configuration and applies the timeouts to the upstream transport
+func corsLimitsInit() {
+	corsLimits = corsProxyLimits{
+		maxRequestBody:  config.CorsMaxRequestBody,
+		maxResponseBody: config.CorsMaxResponseBody,
+		dialTimeout:     config.CorsDialTimeout,
+		headerTimeout:   config.CorsHeaderTimeout,
+		totalTimeout:    config.CorsTimeout,
+		maxPerHost:      config.CorsMaxPerHost,
+	}
+	corsDialer.Timeout = corsLimits.dialTimeout
+	corsUpstreamTransport.ResponseHeaderTimeout = corsLimits.headerTimeout
+}
+
+// corsLimitedBody fails with err as soon as more than limit bytes are read
+type corsLimitedBody struct {
+	io.ReadCloser
+	remaining int64
+	err       error
+	exceeded  bool
+}
+
+func limitCorsBody(body io.ReadCloser, limit int64, err error) *corsLimitedBody {
+	return &corsLimitedBody{ReadCloser: body, remaining: limit, err: err}
+}
+
+func (b *corsLimitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		// Only fail if there really is more than the limit
+		var probe [1]byte
+		n, err := b.ReadCloser.Read(probe[:])
+		if n > 0 {
+			b.exceeded = true
+			return 0, b.err
+		}
+		return 0, err
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// isCorsUpgradeRequest detects websocket upgrades, which are exempt from the total timeout
+func isCorsUpgradeRequest(r *http.Request) bool {
+	return strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// corsRequestContext ends a proxied request after the total timeout. Streams only show themselves
+// by the response, so the timeout can be lifted until the shutdown once the response arrived.
+type corsRequestContext struct {
+	context.Context
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	expired int32
+}
+
+// newCorsRequestContext starts the total timeout, a timeout of 0 only ends the request with its parent.
+// release has to be called when the request is done.
+func newCorsRequestContext(parent context.Context, timeout time.Duration) *corsRequestContext {
+	ctx, cancel := context.WithCancel(parent)
+	c := &corsRequestContext{Context: ctx, cancel: cancel}
+	if timeout > 0 {
+		c.timer = time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&c.expired, 1)
+			cancel()
+		})
+	}
+	return c
+}
+
+// Err reports context.DeadlineExceeded once the total timeout expired, like a context with a deadline
+func (c *corsRequestContext) Err() error {
+	err := c.Context.Err()
+	if err != nil && atomic.LoadInt32(&c.expired) == 1 {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// untilShutdown lifts the total timeout, the request is ended by the shutdown instead of holding it up until the deadline
+func (c *corsRequestContext) untilShutdown() {
+	if c.timer != nil && !c.timer.Stop() {
+		// The timeout already expired
+		return
+	}
+	go func() {
+		select {
+		case <-shuttingDown:
+			c.cancel()
+		case <-c.Done():
+		}
+	}()
+}
+
+func (c *corsRequestContext) release() {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.cancel()
+}
+
+// corsHostLimiter caps the concurrent requests per target host
+type corsHostLimiter struct {
+	mu    sync.Mutex
+	hosts map[string]*corsHostSlots
+}
+
+type corsHostSlots struct {
+	slots chan struct{}
+	// Requests holding or waiting for a slot, the host is forgotten when it drops to 0
+	refs int
+}
+
+var corsHosts = &corsHostLimiter{hosts: make(map[string]*corsHostSlots)}
+
+// acquire waits for a free slot for the host, at most for the total timeout.
+// The returned function has to be called to give the slot back.
+func (l *corsHostLimiter) acquire(ctx context.Context, host string) (func(), error) {
+	if corsLimits.maxPerHost == 0 {
+		return func() {}, nil
+	}
+	if corsLimits.totalTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, corsLimits.totalTimeout)
+		defer cancel()
+	}
+	l.mu.Lock()
+	h := l.hosts[host]
+	if h == nil {
+		h = &corsHostSlots{slots: make(chan struct{}, corsLimits.maxPerHost)}
+		l.hosts[host] = h
+	}
+	h.refs++
+	l.mu.Unlock()
+	forget := func() {
+		l.mu.Lock()
+		h.refs--
+		if h.refs == 0 {
+			delete(l.hosts, host)
+		}
+		l.mu.Unlock()
+	}
+	select {
+	case h.slots <- struct{}{}:
+		return func() {
+			<-h.slots
+			forget()
+		}, nil
+	case <-ctx.Done():
+		forget()
+		return nil, errCorsHostBusy
+	}
+}
+
+// corsTimeoutMessage explains which timeout an upstream error was caused by, it is empty for other errors
+func corsTimeoutMessage(r *http.Request, err error) string {
+	if r.Context().Err() == context.DeadlineExceeded {
+		return "upstream did not answer within the total timeout of " + corsLimits.totalTimeout.String()
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		return ""
+	}
+	var opErr *net.OpError
+	// The tls handshake timeout has no exported error type
+	if (errors.As(err, &opErr) && opErr.Op == "dial") || strings.Contains(err.Error(), "TLS handshake timeout") {
+		return "connecting to the upstream timed out after " + corsLimits.dialTimeout.String()
+	}
+	return "upstream did not send response headers within " + corsLimits.headerTimeout.String()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCorsRequestContext(t *testing.T) {
+	ctx := newCorsRequestContext(context.Background(), 10*time.Millisecond)
+	defer ctx.release()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("request was not ended by the total timeout")
+	}
+	if ctx.Err() != context.DeadlineExceeded {
+		t.Errorf("Err() = %v after the total timeout, want %v", ctx.Err(), context.DeadlineExceeded)
+	}
+
+	// A stream keeps running past the total timeout
+	stream := newCorsRequestContext(context.Background(), 10*time.Millisecond)
+	stream.untilShutdown()
+	select {
+	case <-stream.Done():
+		t.Fatal("stream was ended by the lifted total timeout")
+	case <-time.After(50 * time.Millisecond):
+	}
+	stream.release()
+	if stream.Err() != context.Canceled {
+		t.Errorf("Err() = %v after release, want %v", stream.Err(), context.Canceled)
+	}
+}
+
+func TestCorsLimitedBody(t *testing.T) {
+	tests := []struct {
+		body     string
+		limit    int64
+		exceeded bool
+	}{
+		{"", 4, false},
+		{"abc", 4, false},
+		{"abcd", 4, false},
+		{"abcde", 4, true},
+		{"abcdefghij", 4, true},
+	}
+	for _, test := range tests {
+		body := limitCorsBody(ioutil.NopCloser(strings.NewReader(test.body)), test.limit, errCorsResponseTooLarge)
+		read, err := ioutil.ReadAll(body)
+		if test.exceeded {
+			if err != errCorsResponseTooLarge || !body.exceeded {
+				t.Errorf("reading %q with limit %d returned %v, want %v", test.body, test.limit, err, errCorsResponseTooLarge)
+			}
+			if int64(len(read)) > test.limit {
+				t.Errorf("reading %q with limit %d returned %d bytes", test.body, test.limit, len(read))
+			}
+			continue
+		}
+		if err != nil || string(read) != test.body || body.exceeded {
+			t.Errorf("reading %q with limit %d = %q, %v, want the whole body", test.body, test.limit, read, err)
+		}
+	}
+}
+
+func TestCorsHostLimiter(t *testing.T) {
+	previous := corsLimits
+	t.Cleanup(func() { corsLimits = previous })
+	corsLimits.maxPerHost = 1
+	corsLimits.totalTimeout = 20 * time.Millisecond
+	limiter := &corsHostLimiter{hosts: make(map[string]*corsHostSlots)}
+
+	release, err := limiter.acquire(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := limiter.acquire(context.Background(), "example.com"); err != errCorsHostBusy {
+		t.Errorf("second request to a busy host returned %v, want %v", err, errCorsHostBusy)
+	}
+	other, err := limiter.acquire(context.Background(), "example.org")
+	if err != nil {
+		t.Errorf("request to another host returned %v", err)
+	} else {
+		other()
+	}
+	release()
+	again, err := limiter.acquire(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("request after the release returned %v", err)
+	}
+	again()
+	if len(limiter.hosts) != 0 {
+		t.Errorf("limiter still tracks %d hosts without requests", len(limiter.hosts))
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type corsLogEntry struct {
+	ID         int64     `json:"id"`
+	Time       time.Time `json:"time"`
+	ClientIP   string    `json:"client_ip"`
+	Origin     string    `json:"origin"`
+	Target     string    `json:"target"`
+	TargetHost string    `json:"target_host"`
+	Method     string    `json:"method"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+}
+
+// Entries are written by a single worker so logging never blocks a proxied request
+var corsLogQueue = make(chan corsLogEntry, 1000)
+
+// Closed to stop the worker, which closes corsLogDone once the queued entries are written
+var corsLogStop = make(chan struct{})
+var corsLogDone = make(chan struct{})
+
+// corsLogInit starts the writer and the cleanup of expired entries
+func corsLogInit() {
+	retention := config.CorsLogRetention
+	go corsLogWriter()
+	onShutdown("cors log", func(ctx context.Context) error {
+		close(corsLogStop)
+		select {
+		case <-corsLogDone:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	go func() {
+		for {
+			res, err := db.Exec(`DELETE FROM cors_log WHERE time < $1`, time.Now().Add(-retention))
+			if err != nil {
+				corsLog.Error("Error deleting expired cors log entries: ", err)
+			} else if deleted, _ := res.RowsAffected(); deleted > 0 {
+				corsLog.Info("Deleted " + strconv.FormatInt(deleted, 10) + " expired cors log entries")
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func corsLogWriter() {
+	defer close(corsLogDone)
+	for {
+		select {
+		case entry := <-corsLogQueue:
+			saveCorsLogEntry(entry)
+		case <-corsLogStop:
+			// Write what is still queued before stopping
+			for {
+				select {
+				case entry := <-corsLogQueue:
+					saveCorsLogEntry(entry)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func saveCorsLogEntry(entry corsLogEntry) {
+	_, err := db.Exec(`INSERT INTO cors_log (time, client_ip, origin, target, target_host, method, status, bytes) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		entry.Time, entry.ClientIP, entry.Origin, entry.Target, entry.TargetHost, entry.Method, entry.Status, entry.Bytes)
+	if err != nil {
+		corsLog.Error("Error saving cors log entry: ", err)
+	}
+}
+
+// logCorsRequest queues a proxied request for the log, it has to be called after the response was written
+func logCorsRequest(c *gin.Context, start time.Time, target string, targetHost string) {
+	bytes := int64(c.Writer.Size())
+	if bytes < 0 {
+		bytes = 0
+	}
+	entry := corsLogEntry{
+		Time:       start,
+		ClientIP:   clientIP(c.Request),
+		Origin:     c.GetHeader("Origin"),
+		Target:     target,
+		TargetHost: targetHost,
+		Method:     c.Request.Method,
+		Status:     c.Writer.Status(),
+		Bytes:      bytes,
+	}
+	select {
+	case corsLogQueue <- entry:
+	default:
+		corsLog.Warning("Cors log queue is full, dropping entry for " + target)
+	}
+}
+
+// corsLogRoutes registers the admin endpoint to search the cors log
+func corsLogRoutes(router *gin.Engine) {
+	router.GET("/admin/cors-log", requireScope("cors:log"), searchCorsLog)
+}
+
+// searchCorsLog lists log entries, newest first, filtered by target host (including subdomains) and client ip
+func searchCorsLog(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit has to be a number between 1 and 1000"})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset has to be a positive number"})
+		return
+	}
+	// The subdomains are matched by suffix instead of LIKE, which would treat % and _ in the host as wildcards
+	rows, err := db.Query(`SELECT id, time, client_ip, origin, target, target_host, method, status, bytes FROM cors_log WHERE (length($1)=0 OR target_host=$1 OR right(target_host, length($1)+1) = '.' || $1) AND (length($2)=0 OR client_ip=$2) ORDER BY time DESC LIMIT $3 OFFSET $4`,
+		c.Query("host"), c.Query("client"), limit, offset)
+	if err != nil {
+		apiLog.Error("Error searching cors log: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	defer rows.Close()
+	entries := []corsLogEntry{}
+	for rows.Next() {
+		var entry corsLogEntry
+		if err := rows.Scan(&entry.ID, &entry.Time, &entry.ClientIP, &entry.Origin, &entry.Target, &entry.TargetHost, &entry.Method, &entry.Status, &entry.Bytes); err != nil {
+			apiLog.Error("Error scanning cors log entry: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			return
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		apiLog.Error("Error iterating cors log: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries, "limit": limit, "offset": offset})
+}
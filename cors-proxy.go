@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/keybase/go-logging"
+)
+
+var corsLog = logging.MustGetLogger("cors")
+
+var errCorsTargetForbidden = errors.New("target address is not allowed")
+
+// Networks the proxy must never connect to
+var corsBlockedNetworks = parseCIDRs(
+	"0.0.0.0/8",      // "this" network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier grade nat
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link local, cloud metadata services
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // ietf protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved and broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"::/96",          // ipv4 compatible
+	"64:ff9b::/96",   // ipv4 translation
+	"64:ff9b:1::/48", // local ipv4 translation
+	"2001::/32",      // teredo, tunnels to an embedded ipv4 address
+	"2002::/16",      // 6to4, tunnels to an embedded ipv4 address
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link local
+	"ff00::/8",       // multicast
+)
+
+// corsDialer checks the address of every connection after dns resolution,
+// so the check also holds for redirects and dns rebinding
+var corsDialer = &net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+	Control:   corsDialControl,
+}
+
+var corsUpstreamTransport = &http.Transport{
+	DialContext:           corsDialer.DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+// corsUpstreamRoundTrip sends a request to the upstream and counts the response status
+func corsUpstreamRoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := corsUpstreamTransport.RoundTrip(r)
+	if err != nil {
+		countCorsUpstreamResponse(0, err)
+		return nil, err
+	}
+	countCorsUpstreamResponse(resp.StatusCode, nil)
+	return resp, nil
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func corsDialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		corsLog.Warning("Blocked connection to " + address)
+		return errCorsTargetForbidden
+	}
+	return nil
+}
+
+// isPublicIP reports whether ip is a globally routable unicast address
+func isPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if ip.IsUnspecified() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range corsBlockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// corsHostAllowed checks a host against the patterns in CORS_ALLOW_HOSTS and CORS_DENY_HOSTS.
+// Patterns are comma separated and may contain wildcards like *.example.com,
+// if CORS_ALLOW_HOSTS is empty all hosts that aren't denied are allowed.
+func corsHostAllowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if matchesHostPattern(host, config.CorsDenyHosts) {
+		return false
+	}
+	allowed := strings.TrimSpace(config.CorsAllowHosts)
+	return allowed == "" || matchesHostPattern(host, allowed)
+}
+
+func matchesHostPattern(host, patterns string) bool {
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if matched, _ := path.Match(pattern, host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle Cors Proxy
+func corsRoutes(router *gin.Engine) {
+	router.Any("/*proxyPath", corsProxy)
+}
+
+type corsTransport http.Header
+
+func (t corsTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	roundTrip := corsUpstreamRoundTrip
+	if corsCache != nil {
+		roundTrip = corsCache.RoundTrip
+	}
+	resp, err := roundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	setCorsResponseHeaders(resp.Header, r.Header.Get("Origin"))
+	return resp, nil
+}
+
+// Response headers browsers expose without being listed in Access-Control-Expose-Headers
+var corsSafelistedResponseHeaders = map[string]bool{
+	"Cache-Control":    true,
+	"Content-Language": true,
+	"Content-Length":   true,
+	"Content-Type":     true,
+	"Expires":          true,
+	"Last-Modified":    true,
+	"Pragma":           true,
+}
+
+// Headers that are never exposed to scripts, the browser handles them itself
+var corsHiddenResponseHeaders = map[string]bool{
+	"Connection": true,
+	"Set-Cookie": true,
+	"Upgrade":    true,
+	"Vary":       true,
+}
+
+// corsCredentialsAllowed checks the origin against the patterns in CORS_CREDENTIAL_ORIGINS (e.g. https://*.tasadar.net)
+func corsCredentialsAllowed(origin string) bool {
+	return origin != "" && matchesHostPattern(strings.ToLower(origin), config.CorsCredentialOrigins)
+}
+
+// setCorsAllowOrigin allows the origin, with credentials if it is configured for them
+func setCorsAllowOrigin(header http.Header, origin string) {
+	header.Add("Vary", "Origin")
+	if corsCredentialsAllowed(origin) {
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Set("Access-Control-Allow-Credentials", "true")
+	} else {
+		header.Set("Access-Control-Allow-Origin", "*")
+	}
+}
+
+// setCorsResponseHeaders replaces the cors headers of the upstream and exposes all of its headers
+func setCorsResponseHeaders(header http.Header, origin string) {
+	var expose []string
+	for name := range header {
+		if strings.HasPrefix(name, "Access-Control-") {
+			header.Del(name)
+		} else if !corsSafelistedResponseHeaders[name] && !corsHiddenResponseHeaders[name] {
+			expose = append(expose, name)
+		}
+	}
+	setCorsAllowOrigin(header, origin)
+	if len(expose) > 0 {
+		sort.Strings(expose)
+		header.Set("Access-Control-Expose-Headers", strings.Join(expose, ", "))
+	}
+}
+
+// corsPreflight answers a preflight request without contacting the upstream
+// by allowing exactly the requested method and headers
+func corsPreflight(c *gin.Context) {
+	header := c.Writer.Header()
+	setCorsAllowOrigin(header, c.GetHeader("Origin"))
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+	header.Set("Access-Control-Allow-Methods", c.GetHeader("Access-Control-Request-Method"))
+	if requestedHeaders := c.GetHeader("Access-Control-Request-Headers"); requestedHeaders != "" {
+		header.Set("Access-Control-Allow-Headers", requestedHeaders)
+	}
+	header.Set("Access-Control-Max-Age", "86400")
+	c.Status(http.StatusNoContent)
+}
+
+func corsProxy(c *gin.Context) {
+	if c.Param("proxyPath") == "/" {
+		c.String(200, "Just append the url(including protocol) you want to call to the domain.\nAttention: For legal reasons requests are logged!")
+		return
+	}
+	if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+		corsPreflight(c)
+		return
+	}
+	remote, err := corsTargetURL(c.Request)
+	if err != nil || (remote.Scheme != "http" && remote.Scheme != "https") || remote.Hostname() == "" {
+		writeCorsError(c.Writer, c.Request, http.StatusBadRequest, "invalid target url")
+		return
+	}
+	defer logCorsRequest(c, time.Now(), remote.String(), remote.Hostname())
+	if !corsHostAllowed(remote.Hostname()) {
+		writeCorsError(c.Writer, c.Request, http.StatusForbidden, "target host is not allowed")
+		return
+	}
+
+	if corsLimits.maxRequestBody > 0 && c.Request.ContentLength > corsLimits.maxRequestBody {
+		writeCorsError(c.Writer, c.Request, http.StatusRequestEntityTooLarge, corsRequestTooLargeMessage())
+		return
+	}
+	if corsLimits.maxRequestBody > 0 && c.Request.Body != nil && c.Request.Body != http.NoBody {
+		c.Request.Body = limitCorsBody(c.Request.Body, corsLimits.maxRequestBody, errCorsRequestTooLarge)
+	}
+	requestContext := newCorsRequestContext(c.Request.Context(), corsLimits.totalTimeout)
+	defer requestContext.release()
+	if isCorsUpgradeRequest(c.Request) {
+		requestContext.untilShutdown()
+	}
+	c.Request = c.Request.WithContext(requestContext)
+	release, err := corsHosts.acquire(c.Request.Context(), strings.ToLower(remote.Hostname()))
+	if err != nil {
+		writeCorsError(c.Writer, c.Request, http.StatusGatewayTimeout, "too many concurrent requests to "+remote.Hostname()+", gave up waiting")
+		return
+	}
+	defer release()
+
+	var responseBody *corsLimitedBody
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+		if recovered != http.ErrAbortHandler {
+			panic(recovered)
+		}
+		// The response was already started, closing the connection lets the client notice that it is incomplete
+		if responseBody != nil && responseBody.exceeded {
+			corsLog.Warning("Truncated response from " + remote.Host + " at CORS_MAX_RESPONSE_BODY of " + strconv.FormatInt(corsLimits.maxResponseBody, 10) + " bytes")
+		} else {
+			corsLog.Warning("Aborted response from " + remote.Host + " after the upstream body failed")
+		}
+		if conn, _, err := c.Writer.Hijack(); err == nil {
+			_ = conn.Close()
+		}
+	}()
+
+	proxyBase := requestBaseURL(c.Request)
+	proxy := httputil.ReverseProxy{Director: func(req *http.Request) {
+		req.Header = c.Request.Header
+		req.Host = remote.Host
+		req.URL.Scheme = remote.Scheme
+		req.URL.Host = remote.Host
+		req.URL.Path = remote.Path
+		req.URL.RawPath = remote.RawPath
+		req.URL.RawQuery = remote.RawQuery
+	}, Transport: corsTransport(http.Header{}),
+		ModifyResponse: func(resp *http.Response) error {
+			rewriteCorsLocation(resp, proxyBase)
+			rewriteCorsCookies(resp, proxyBase)
+			// Event streams are exempt from the total timeout, the reverse proxy passes their events on as soon as they arrive
+			if isEventStreamResponse(resp) {
+				requestContext.untilShutdown()
+			}
+			// Upgraded connections are tunneled and not limited
+			if corsLimits.maxResponseBody > 0 && resp.StatusCode != http.StatusSwitchingProtocols {
+				if resp.ContentLength > corsLimits.maxResponseBody {
+					return errCorsResponseTooLarge
+				}
+				responseBody = limitCorsBody(resp.Body, corsLimits.maxResponseBody, errCorsResponseTooLarge)
+				resp.Body = responseBody
+			}
+			return nil
+		},
+		ErrorHandler: corsErrorHandler,
+	}
+	proxy.ServeHTTP(c.Writer, c.Request)
+}
+
+// isEventStreamRequest detects requests for server sent events
+func isEventStreamRequest(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// isEventStreamResponse detects server sent events by the content type the upstream answered with
+func isEventStreamResponse(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// corsTargetURL reconstructs the target url including its query from the raw request uri
+func corsTargetURL(r *http.Request) (*url.URL, error) {
+	raw := strings.TrimPrefix(r.RequestURI, "/")
+	// Browsers send urls that were encoded as a whole with encodeURIComponent
+	if lower := strings.ToLower(raw); strings.HasPrefix(lower, "http%3a") || strings.HasPrefix(lower, "https%3a") {
+		decoded, err := url.PathUnescape(raw)
+		if err != nil {
+			return nil, err
+		}
+		raw = decoded
+	}
+	// Some clients and proxies merge the slashes after the scheme
+	if i := strings.Index(raw, ":/"); i > 0 && !strings.HasPrefix(raw[i:], "://") {
+		raw = raw[:i] + "://" + raw[i+2:]
+	}
+	target, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	// Fragments only have a meaning for the client
+	target.Fragment = ""
+	target.RawFragment = ""
+	// Websockets are proxied as http upgrade requests
+	switch strings.ToLower(target.Scheme) {
+	case "ws":
+		target.Scheme = "http"
+	case "wss":
+		target.Scheme = "https"
+	}
+	return target, nil
+}
+
+// requestBaseURL is the url of the server itself as seen by the client, e.g. https://cors.tasadar.net/
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/"
+}
+
+// rewriteCorsLocation lets redirects of the upstream point back through the proxy
+func rewriteCorsLocation(resp *http.Response, proxyBase string) {
+	for _, name := range []string{"Location", "Content-Location"} {
+		location := resp.Header.Get(name)
+		if location == "" {
+			continue
+		}
+		target, err := resp.Request.URL.Parse(location)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") {
+			continue
+		}
+		resp.Header.Set(name, proxyBase+target.String())
+	}
+}
+
+// rewriteCorsCookies scopes upstream cookies to the path of the upstream origin on the proxy,
+// so the browser only sends them back through the proxy to the upstream that set them
+func rewriteCorsCookies(resp *http.Response, proxyBase string) {
+	cookies := resp.Cookies()
+	if len(cookies) == 0 {
+		return
+	}
+	origin := resp.Request.URL.Scheme + "://" + resp.Request.URL.Host
+	resp.Header.Del("Set-Cookie")
+	for _, cookie := range cookies {
+		cookiePath := cookie.Path
+		if !strings.HasPrefix(cookiePath, "/") {
+			cookiePath = "/"
+		}
+		cookie.Path = "/" + origin + cookiePath
+		cookie.Domain = ""
+		if strings.HasPrefix(proxyBase, "https://") {
+			// Requests through the proxy are cross site for the calling app
+			cookie.Secure = true
+			cookie.SameSite = http.SameSiteNoneMode
+		}
+		resp.Header.Add("Set-Cookie", cookie.String())
+	}
+}
+
+// corsErrorHandler answers failed upstream requests with a json error
+func corsErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusBadGateway
+	message := "upstream request failed"
+	if errors.Is(err, errCorsTargetForbidden) {
+		status = http.StatusForbidden
+		message = "target address is not allowed"
+	} else if errors.Is(err, errCorsRequestTooLarge) {
+		status = http.StatusRequestEntityTooLarge
+		message = corsRequestTooLargeMessage()
+	} else if errors.Is(err, errCorsResponseTooLarge) {
+		message = "upstream response exceeds the limit of " + strconv.FormatInt(corsLimits.maxResponseBody, 10) + " bytes"
+		corsLog.Warning("Refused response from " + r.URL.Host + ": " + message)
+	} else if timeout := corsTimeoutMessage(r, err); timeout != "" {
+		status = http.StatusGatewayTimeout
+		message = timeout
+		corsLog.Warning("Timeout proxying to " + r.URL.Host + ": " + message)
+	} else {
+		corsLog.Warning("Error proxying to "+r.URL.Host+": ", err)
+	}
+	writeCorsError(w, r, status, message)
+}
+
+func corsRequestTooLargeMessage() string {
+	return "request body exceeds the limit of " + strconv.FormatInt(corsLimits.maxRequestBody, 10) + " bytes"
+}
+
+// writeCorsError writes a json error that the requesting origin is allowed to read
+func writeCorsError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	body, _ := json.Marshal(map[string]string{"error": message})
+	setCorsAllowOrigin(w.Header(), r.Header.Get("Origin"))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"8.8.8.8", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"0.0.0.0", false},
+		{"10.1.2.3", false},
+		{"100.64.0.1", false},
+		{"127.0.0.1", false},
+		{"169.254.169.254", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"198.18.0.1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::127.0.0.1", false},
+		{"64:ff9b::7f00:1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"ff02::1", false},
+		// 6to4 and teredo addresses embed an ipv4 address the relay connects to
+		{"2002:7f00:1::", false},
+		{"2002:a9fe:a9fe::1", false},
+		{"2001:0:4136:e378:8000:63bf:80ff:fffe", false},
+	}
+	for _, test := range tests {
+		ip := net.ParseIP(test.ip)
+		if ip == nil {
+			t.Fatalf("invalid test address %s", test.ip)
+		}
+		if got := isPublicIP(ip); got != test.public {
+			t.Errorf("isPublicIP(%s) = %v, want %v", test.ip, got, test.public)
+		}
+	}
+}
+
+func TestCorsDialControl(t *testing.T) {
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"93.184.216.34:443", true},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:80", true},
+		{"127.0.0.1:80", false},
+		{"[::1]:80", false},
+		{"[2002:7f00:1::]:80", false},
+		{"localhost:80", false},
+		{"93.184.216.34", false},
+	}
+	for _, test := range tests {
+		err := corsDialControl("tcp", test.address, nil)
+		if (err == nil) != test.allowed {
+			t.Errorf("corsDialControl(%s) = %v, want allowed %v", test.address, err, test.allowed)
+		}
+	}
+}
+
+func TestCorsHostAllowed(t *testing.T) {
+	previous := config
+	t.Cleanup(func() { config = previous })
+
+	tests := []struct {
+		allow   string
+		deny    string
+		host    string
+		allowed bool
+	}{
+		{"", "", "example.com", true},
+		{"", "example.com", "example.com", false},
+		{"", "example.com", "EXAMPLE.com.", false},
+		{"", "*.example.com", "api.example.com", false},
+		{"", "*.example.com", "example.com", true},
+		{"example.com, *.example.org", "", "example.com", true},
+		{"example.com, *.example.org", "", "api.example.org", true},
+		{"example.com, *.example.org", "", "example.net", false},
+		{"*.example.org", "secret.example.org", "secret.example.org", false},
+	}
+	for _, test := range tests {
+		config.CorsAllowHosts = test.allow
+		config.CorsDenyHosts = test.deny
+		if got := corsHostAllowed(test.host); got != test.allowed {
+			t.Errorf("corsHostAllowed(%q) with allow %q and deny %q = %v, want %v", test.host, test.allow, test.deny, got, test.allowed)
+		}
+	}
+}
+
+func TestCorsTargetURL(t *testing.T) {
+	tests := []struct {
+		requestURI string
+		target     string
+	}{
+		{"/https://example.com/path?a=b&c=d", "https://example.com/path?a=b&c=d"},
+		{"/https://example.com/a%2Fb?q=%20", "https://example.com/a%2Fb?q=%20"},
+		{"/https%3A%2F%2Fexample.com%2Fpath%3Fa%3Db", "https://example.com/path?a=b"},
+		{"/https:/example.com/path", "https://example.com/path"},
+		{"/http://example.com/#fragment", "http://example.com/"},
+		{"/ws://example.com/socket", "http://example.com/socket"},
+		{"/wss://example.com/socket", "https://example.com/socket"},
+	}
+	for _, test := range tests {
+		target, err := corsTargetURL(&http.Request{RequestURI: test.requestURI})
+		if err != nil {
+			t.Errorf("corsTargetURL(%s) failed: %v", test.requestURI, err)
+			continue
+		}
+		if target.String() != test.target {
+			t.Errorf("corsTargetURL(%s) = %s, want %s", test.requestURI, target, test.target)
+		}
+	}
+	if _, err := corsTargetURL(&http.Request{RequestURI: "/https%3A%2F%2Fexample.com%zz"}); err == nil {
+		t.Error("corsTargetURL accepted an invalid escape")
+	}
+}
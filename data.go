@@ -5,7 +5,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"io"
-	"os"
+	"sync"
 	"time"
 
 	"github.com/keybase/go-logging"
@@ -18,6 +18,7 @@ var db *sql.DB
 var dataLog = logging.MustGetLogger("data")
 
 var tmpData map[string]map[string]tmpDataObject
+var tmpDataMutex sync.Mutex
 
 type tmpDataObject struct {
 	data       string
@@ -48,12 +49,8 @@ func dbInit() {
 
 	// Init postgres
 
-	if os.Getenv("DATABASE_URL") == "" {
-		dataLog.Info("Database: " + os.Getenv("DATABASE_URL"))
-		dataLog.Fatal("Fatal Error getting Database Information!")
-	}
 	var err error
-	db, err = sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	db, err = sql.Open("postgres", config.DatabaseURL)
 	if err != nil {
 		dataLog.Fatal("PostgreSQL Server Connection failed: ", err)
 	}
@@ -74,6 +71,35 @@ func dbInit() {
 	if err != nil {
 		dataLog.Fatal("Error creating table quotes: ", err)
 	}
+	// API Tokens, only the sha256 hash of a token is stored
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS api_tokens(id SERIAL PRIMARY KEY, name text NOT NULL, token_hash text UNIQUE NOT NULL, scopes text[] NOT NULL DEFAULT '{}', created_at timestamptz NOT NULL DEFAULT now(), revoked_at timestamptz)`)
+	if err != nil {
+		dataLog.Fatal("Error creating table api_tokens: ", err)
+	}
+	// CORS Proxy Log
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS cors_log(id BIGSERIAL PRIMARY KEY, time timestamptz NOT NULL, client_ip text NOT NULL, origin text NOT NULL, target text NOT NULL, target_host text NOT NULL, method text NOT NULL, status integer NOT NULL, bytes bigint NOT NULL)`)
+	if err != nil {
+		dataLog.Fatal("Error creating table cors_log: ", err)
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS cors_log_time ON cors_log(time); CREATE INDEX IF NOT EXISTS cors_log_target_host ON cors_log(target_host); CREATE INDEX IF NOT EXISTS cors_log_client_ip ON cors_log(client_ip)`)
+	if err != nil {
+		dataLog.Fatal("Error creating indexes for cors_log: ", err)
+	}
+	// CORS Proxy Cache
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS cors_cache(key text PRIMARY KEY, status integer NOT NULL, header text NOT NULL, body bytea NOT NULL, vary text NOT NULL, stored_at timestamptz NOT NULL, expires_at timestamptz NOT NULL, etag text NOT NULL, last_modified text NOT NULL)`)
+	if err != nil {
+		dataLog.Fatal("Error creating table cors_cache: ", err)
+	}
+	// Short Links
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS links(slug text PRIMARY KEY, target text NOT NULL, code integer NOT NULL DEFAULT 302, expires_at timestamptz, clicks bigint NOT NULL DEFAULT 0, created_at timestamptz NOT NULL DEFAULT now())`)
+	if err != nil {
+		dataLog.Fatal("Error creating table links: ", err)
+	}
+	// The links that used to be hardcoded
+	_, err = db.Exec(`INSERT INTO links (slug, target, code) VALUES ('discord', 'https://discord.gg/CSZyd87', 302), ('glyph', 'https://discordapp.com/oauth2/authorize?client_id=635860503041802253&scope=bot&permissions=8', 302) ON CONFLICT (slug) DO NOTHING`)
+	if err != nil {
+		dataLog.Fatal("Error seeding table links: ", err)
+	}
 }
 
 // TODO This should handle saving arbitrary objects to key value store
@@ -113,6 +139,8 @@ func SetRemove(key, value string) error {
 }*/
 
 func setTmp(bucket string, key string, value string, duration time.Duration) {
+	tmpDataMutex.Lock()
+	defer tmpDataMutex.Unlock()
 	var dataToSave tmpDataObject
 	dataToSave.data = value
 	dataToSave.validUntil = time.Now().Add(duration)
@@ -124,6 +152,8 @@ func setTmp(bucket string, key string, value string, duration time.Duration) {
 }
 
 func getTmp(bucket string, key string) string {
+	tmpDataMutex.Lock()
+	defer tmpDataMutex.Unlock()
 	if tmpData[bucket] == nil {
 		return ""
 	}
@@ -136,12 +166,25 @@ func getTmp(bucket string, key string) string {
 }
 
 func delTmp(bucket string, key string) {
+	tmpDataMutex.Lock()
+	defer tmpDataMutex.Unlock()
 	if tmpData[bucket] == nil {
 		return
 	}
 	delete(tmpData[bucket], key)
 }
 
+// tmpSizes counts the entries of every bucket of the RAM store, including expired ones that weren't read since
+func tmpSizes() map[string]int {
+	tmpDataMutex.Lock()
+	defer tmpDataMutex.Unlock()
+	sizes := make(map[string]int, len(tmpData))
+	for bucket, entries := range tmpData {
+		sizes[bucket] = len(entries)
+	}
+	return sizes
+}
+
 /*func set(key string, value string) error {
     return redclient.Set(key, value, 0).Err()
 }
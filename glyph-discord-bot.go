@@ -1,22 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"math/rand"
-	"os"
-	"os/signal"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
 	_ "github.com/heroku/x/hmetrics/onload"
 	"github.com/keybase/go-logging"
-	UniPassauBot "github.com/tionis/uni-passau-bot/api"
 )
 
 // Discord ID of admin
@@ -29,6 +29,9 @@ var onlyOnce sync.Once
 // Logger
 var glyphDiscordLog = logging.MustGetLogger("glyphDiscord")
 
+// Held by running handlers, the shutdown takes it to wait for them
+var glyphDiscordHandlers sync.RWMutex
+
 // Define discord commands
 var (
 	commands = []*discordgo.ApplicationCommand{
@@ -342,29 +345,63 @@ var (
 	}
 )
 
+// Shared discord session used by the bot and the api
+var discordSession *discordgo.Session
+var discordSessionOnce sync.Once
+var errDiscordSession error
+
+// getDiscordSession returns the shared discord session and creates it on first use.
+// The REST endpoints can be used without opening the websocket connection.
+func getDiscordSession() (*discordgo.Session, error) {
+	discordSessionOnce.Do(func() {
+		if config.DiscordToken == "" {
+			errDiscordSession = errors.New("DISCORD_TOKEN is not configured")
+			return
+		}
+		discordSession, errDiscordSession = discordgo.New("Bot " + config.DiscordToken)
+	})
+	return discordSession, errDiscordSession
+}
+
 // Main and Init
-func glyphDiscordBot() {
-	dg, err := discordgo.New("Bot " + os.Getenv("DISCORD_TOKEN"))
+func glyphDiscordBot(ctx context.Context) error {
+	dg, err := getDiscordSession()
 	if err != nil {
-		glyphDiscordLog.Error("Error creating Discord session,", err)
+		return err
 	}
 
 	// Register the messageCreate func as a callback for MessageCreate events.
-	dg.AddHandler(messageCreate)
-	dg.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
-		if h, ok := commandHandlers[i.Data.Name]; ok {
-			h(s, i)
+	// Handlers run in their own goroutines and hold glyphDiscordHandlers so the shutdown can wait for them.
+	// The session is shared, so the handlers are removed again when the bot stops.
+	removeHandlers := []func(){
+		dg.AddHandler(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+			glyphDiscordHandlers.RLock()
+			defer glyphDiscordHandlers.RUnlock()
+			defer recoverGlyphDiscordHandler()
+			messageCreate(s, m)
+		}),
+		dg.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			glyphDiscordHandlers.RLock()
+			defer glyphDiscordHandlers.RUnlock()
+			defer recoverGlyphDiscordHandler()
+			if h, ok := commandHandlers[i.Data.Name]; ok {
+				h(s, i)
+			}
+		}),
+		dg.AddHandler(func(s *discordgo.Session, r *discordgo.Ready) {
+			log.Println("Bot is up!")
+		}),
+	}
+	defer func() {
+		for _, remove := range removeHandlers {
+			remove()
 		}
-	})
-	dg.AddHandler(func(s *discordgo.Session, r *discordgo.Ready) {
-		log.Println("Bot is up!")
-	})
+	}()
 
 	// Open a websocket connection to Discord and begin listening.
 	err = dg.Open()
 	if err != nil {
-		glyphDiscordLog.Error("Error opening connection,", err)
-		return
+		return err
 	}
 
 	// Set some StartUp Stuff
@@ -375,14 +412,30 @@ func glyphDiscordBot() {
 	  }*/
 	_ = dg.UpdateGameStatus(0, "/help for help")
 
-	// Wait here until CTRL-C or other term signal is received.
+	// The session runs in the background until ctx is done
 	glyphDiscordLog.Info("Glyph Discord Bot was started.")
-	sc := make(chan os.Signal, 1)
-	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt, syscall.SIGQUIT, syscall.SIGHUP)
-	<-sc
+	atomic.StoreInt32(&glyphDiscordRunning, 1)
+	<-ctx.Done()
+	atomic.StoreInt32(&glyphDiscordRunning, 0)
 
-	// Cleanly close down the Discord session.
-	_ = dg.Close()
+	// Wait for the running handlers to send their answers, then close the gateway connection
+	glyphDiscordHandlers.Lock()
+	defer glyphDiscordHandlers.Unlock()
+	glyphDiscordLog.Info("Glyph Discord Bot was stopped")
+	return dg.Close()
+}
+
+// recoverGlyphDiscordHandler keeps a panicking handler from taking down the process, discordgo doesn't recover them
+func recoverGlyphDiscordHandler() {
+	if r := recover(); r != nil {
+		glyphDiscordLog.Error("Handler panicked: ", r, "\n", string(debug.Stack()))
+	}
+}
+
+// glyphDiscordCommands are the commands handled by messageCreate
+var glyphDiscordCommands = map[string]bool{
+	"/roll": true, "/r": true, "/diag": true, "/help": true, "/unip": true, "/pnp": true, "/gm": true, "/GM": true,
+	"/food": true, "/save": true, "/ping": true, "/id": true, "/whoami": true, "/todo": true, "/isDM": true,
 }
 
 // This function will be called (due to AddHandler above) every time a new
@@ -422,6 +475,12 @@ func messageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 	inputString := strings.Split(m.Content, " ")
 	if strings.Contains(inputString[0], "/") {
 		glyphDiscordLog.Info(m.Author.Username + ": " + m.Content)
+		command := strings.ToLower(inputString[0])
+		if !glyphDiscordCommands[inputString[0]] {
+			// Keep arbitrary words like urls out of the metrics labels
+			command = "other"
+		}
+		countBotCommand("discord", command)
 	}
 	switch inputString[0] {
 	// Dice commands
@@ -461,9 +520,9 @@ func messageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 		}
 	// Food commands
 	case "/food":
-		_, _ = s.ChannelMessageSend(m.ChannelID, UniPassauBot.FoodToday())
+		_, _ = s.ChannelMessageSend(m.ChannelID, foodText(0))
 	case "/food tomorrow":
-		_, _ = s.ChannelMessageSend(m.ChannelID, UniPassauBot.FoodTomorrow())
+		_, _ = s.ChannelMessageSend(m.ChannelID, foodText(1))
 
 	// Config commands
 	case "/save":
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/keybase/go-logging"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var glyphMatrixLog = logging.MustGetLogger("glyphMatrix")
+
+// Shared matrix client used by the bot and the api
+var matrixClient *mautrix.Client
+var matrixClientMutex sync.Mutex
+
+// getMatrixClient returns the shared matrix client and logs in with the access token on first use.
+// If the homeserver could not be reached, the next call tries again.
+func getMatrixClient() (*mautrix.Client, error) {
+	matrixClientMutex.Lock()
+	defer matrixClientMutex.Unlock()
+	if matrixClient != nil {
+		return matrixClient, nil
+	}
+	if config.MatrixHomeserver == "" || config.MatrixAccessToken == "" {
+		return nil, errors.New("MATRIX_HOMESERVER and MATRIX_ACCESS_TOKEN have to be configured")
+	}
+	client, err := mautrix.NewClient(config.MatrixHomeserver, id.UserID(config.MatrixUserID), config.MatrixAccessToken)
+	if err != nil {
+		return nil, err
+	}
+	// Check the access token and learn our own user id
+	whoami, err := client.Whoami()
+	if err != nil {
+		return nil, err
+	}
+	client.UserID = whoami.UserID
+	matrixClient = client
+	return matrixClient, nil
+}
+
+// GlyphMatrixBot answers the glyph commands in all rooms the bot was invited to, it syncs until ctx is done
+func glyphMatrixBot(ctx context.Context) error {
+	client, err := getMatrixClient()
+	if err != nil {
+		return err
+	}
+	// The client is shared, so the handlers are only registered on the first start
+	glyphMatrixHandlersOnce.Do(func() {
+		registerGlyphMatrixHandlers(client)
+	})
+
+	glyphMatrixLog.Info("Glyph Matrix Bot was started.")
+	atomic.StoreInt32(&glyphMatrixSyncing, 1)
+	defer atomic.StoreInt32(&glyphMatrixSyncing, 0)
+	// Events that were already received are handled before the sync returns
+	err = client.SyncWithContext(ctx)
+	if ctx.Err() != nil {
+		glyphMatrixLog.Info("Glyph Matrix Bot was stopped")
+		return nil
+	}
+	return err
+}
+
+var glyphMatrixHandlersOnce sync.Once
+
+func registerGlyphMatrixHandlers(client *mautrix.Client) {
+	syncer := client.Syncer.(*mautrix.DefaultSyncer)
+	// Don't answer messages that were sent before the bot joined a room
+	oldEventIgnorer := mautrix.OldEventIgnorer{UserID: client.UserID}
+	oldEventIgnorer.Register(syncer)
+
+	// Accept all invites
+	syncer.OnEventType(event.StateMember, func(source mautrix.EventSource, evt *event.Event) {
+		if evt.GetStateKey() != client.UserID.String() || evt.Content.AsMember().Membership != event.MembershipInvite {
+			return
+		}
+		if _, err := client.JoinRoomByID(evt.RoomID); err != nil {
+			glyphMatrixLog.Error("Error joining room "+evt.RoomID.String()+": ", err)
+			return
+		}
+		glyphMatrixLog.Info("Joined room " + evt.RoomID.String() + " after invite by " + evt.Sender.String())
+	})
+
+	// Handle commands
+	startTime := time.Now().UnixNano() / int64(time.Millisecond)
+	syncer.OnEventType(event.EventMessage, func(source mautrix.EventSource, evt *event.Event) {
+		if evt.Sender == client.UserID || evt.Timestamp < startTime {
+			return
+		}
+		message := evt.Content.AsMessage()
+		if message.MsgType != event.MsgText {
+			return
+		}
+		answer, command := glyphMatrixAnswer(evt.Sender, message.Body)
+		if answer == "" {
+			return
+		}
+		glyphMatrixLog.Info(evt.Sender.String() + " in " + evt.RoomID.String() + ": " + message.Body)
+		if command != "" {
+			countBotCommand("matrix", command)
+		}
+		if _, err := client.SendNotice(evt.RoomID, answer); err != nil {
+			glyphMatrixLog.Error("Error answering in room "+evt.RoomID.String()+": ", err)
+		}
+	})
+}
+
+// glyphMatrixAnswer returns the answer to a message and the command it was, the command is empty for the steps of
+// adding a quote and both are empty if the message is neither a known command nor part of such a conversation
+func glyphMatrixAnswer(sender id.UserID, message string) (string, string) {
+	user := "matrix:" + sender.String()
+	command := strings.ToLower(strings.Fields(message + " ")[0])
+	switch command {
+	case "/ping":
+		return "pong", command
+	case "/help":
+		return `Following Commands are Available:
+UniPassau-Commands:
+  - /food - Food for today
+  - /foodtomorrow - Food for tomorrow
+  - /foodweek - Food for week
+Quotator-Commands:
+  - /getquote - Get a random quote. You can also specify parameters by saying for example:  /getquote language german author "Emanuel Kant"
+  - /addquote - add a quote to the database
+  - /quoteoftheday - Get your personal quote of the day`, command
+	case "/food", "/foodtoday":
+		if strings.EqualFold(strings.TrimSpace(message), "/food tomorrow") {
+			return foodText(1), command
+		}
+		if strings.EqualFold(strings.TrimSpace(message), "/food week") {
+			return foodWeekText(), command
+		}
+		return foodText(0), command
+	case "/foodtomorrow":
+		return foodText(1), command
+	case "/foodweek":
+		return foodWeekText(), command
+	case "/getquote":
+		delTmp("glyph", user+"|context")
+		author, language, universe, err := parseGetQuote(strings.TrimSpace(strings.TrimPrefix(message, "/getquote")))
+		if err != nil {
+			glyphMatrixLog.Error("Error parsing getQuote: ", err)
+			return "There was an error please check your command and try again later.", command
+		}
+		return getRandomQuote(author, language, universe), command
+	case "/addquote", "/setquote":
+		setTmp("glyph", user+"|context", "quoteRequired", glyphTelegramContextDelay)
+		return "Please write me your Quote.", command
+	case "/quoteoftheday":
+		return quoteOfTheDay(user), command
+	}
+
+	// The steps of adding a quote
+	switch getTmp("glyph", user+"|context") {
+	case "quoteRequired":
+		setTmp("glyph", user+"|currentQuote", message, glyphTelegramContextDelay)
+		setTmp("glyph", user+"|context", "authorRequired", glyphTelegramContextDelay)
+		return "Thanks, now the author please.", ""
+	case "authorRequired":
+		setTmp("glyph", user+"|currentAuthor", message, glyphTelegramContextDelay)
+		setTmp("glyph", user+"|context", "languageRequired", glyphTelegramContextDelay)
+		return "Thanks, now the language please.", ""
+	case "languageRequired":
+		setTmp("glyph", user+"|currentLanguage", message, glyphTelegramContextDelay)
+		setTmp("glyph", user+"|context", "universeRequired", glyphTelegramContextDelay)
+		return "And now the universe it comes from please:", ""
+	case "universeRequired":
+		setTmp("glyph", user+"|currentUniverse", message, glyphTelegramContextDelay)
+		delTmp("glyph", user+"|context")
+		return addQuote(user), ""
+	}
+	return "", ""
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"maunium.net/go/mautrix/id"
+)
+
+const fakeHomeserverUser = "@bot:test"
+
+// fakeHomeserver answers the client api calls of the matrix bot and records what the bot sends
+type fakeHomeserver struct {
+	*httptest.Server
+	mu     sync.Mutex
+	sent   []map[string]interface{}
+	joined []string
+	// The timeline of the second sync, the first one is ignored by the bot
+	events []map[string]interface{}
+}
+
+func newFakeHomeserver(t *testing.T) *fakeHomeserver {
+	hs := &fakeHomeserver{}
+	hs.Server = httptest.NewServer(http.HandlerFunc(hs.serve))
+	t.Cleanup(hs.Close)
+	return hs
+}
+
+func (hs *fakeHomeserver) serve(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/_matrix/client/r0/")
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case path == "account/whoami":
+		json.NewEncoder(w).Encode(map[string]string{"user_id": fakeHomeserverUser})
+	case path == "user/"+fakeHomeserverUser+"/filter":
+		json.NewEncoder(w).Encode(map[string]string{"filter_id": "1"})
+	case path == "sync":
+		hs.sync(w, r)
+	case strings.HasPrefix(path, "rooms/") && strings.HasSuffix(path, "/join"):
+		roomID := strings.TrimSuffix(strings.TrimPrefix(path, "rooms/"), "/join")
+		hs.mu.Lock()
+		hs.joined = append(hs.joined, roomID)
+		hs.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"room_id": roomID})
+	case strings.HasPrefix(path, "rooms/!forbidden:test/send/"):
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"errcode": "M_FORBIDDEN", "error": "not in the room"})
+	case strings.HasPrefix(path, "rooms/") && strings.Contains(path, "/send/m.room.message/"):
+		var content map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&content)
+		content["room_id"] = strings.SplitN(strings.TrimPrefix(path, "rooms/"), "/", 2)[0]
+		hs.mu.Lock()
+		hs.sent = append(hs.sent, content)
+		eventID := "$sent" + strconv.Itoa(len(hs.sent))
+		hs.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"event_id": eventID})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"errcode": "M_UNRECOGNIZED", "error": "unknown endpoint " + path})
+	}
+}
+
+func (hs *fakeHomeserver) sync(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Query().Get("since") {
+	case "":
+		json.NewEncoder(w).Encode(map[string]interface{}{"next_batch": "1"})
+	case "1":
+		hs.mu.Lock()
+		events := hs.events
+		hs.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"next_batch": "2",
+			"rooms": map[string]interface{}{
+				"join": map[string]interface{}{
+					"!room:test": map[string]interface{}{"timeline": map[string]interface{}{"events": events}},
+				},
+				"invite": map[string]interface{}{
+					"!invite:test": map[string]interface{}{"invite_state": map[string]interface{}{"events": []map[string]interface{}{{
+						"type": "m.room.member", "state_key": fakeHomeserverUser, "sender": "@alice:test",
+						"content": map[string]string{"membership": "invite"},
+					}}}},
+				},
+			},
+		})
+	default:
+		// Long polling without news
+		select {
+		case <-r.Context().Done():
+		case <-time.After(50 * time.Millisecond):
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"next_batch": "2"})
+	}
+}
+
+func (hs *fakeHomeserver) sentMessages() []map[string]interface{} {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return append([]map[string]interface{}{}, hs.sent...)
+}
+
+// useFakeHomeserver points the shared matrix client at hs
+func useFakeHomeserver(t *testing.T, hs *fakeHomeserver) {
+	previous := config
+	config.MatrixHomeserver = hs.URL
+	config.MatrixAccessToken = "secret-access-token"
+	config.MatrixUserID = ""
+	matrixClient = nil
+	glyphMatrixHandlersOnce = sync.Once{}
+	t.Cleanup(func() {
+		config = previous
+		matrixClient = nil
+		glyphMatrixHandlersOnce = sync.Once{}
+	})
+}
+
+func useTmpStore() {
+	tmpDataMutex.Lock()
+	tmpData = make(map[string]map[string]tmpDataObject)
+	tmpDataMutex.Unlock()
+}
+
+func matrixTextEvent(eventID, sender, body string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":             "m.room.message",
+		"event_id":         eventID,
+		"sender":           sender,
+		"origin_server_ts": time.Now().Add(time.Minute).UnixNano() / int64(time.Millisecond),
+		"content":          map[string]string{"msgtype": "m.text", "body": body},
+	}
+}
+
+func TestGlyphMatrixBotSync(t *testing.T) {
+	useTmpStore()
+	hs := newFakeHomeserver(t)
+	hs.events = []map[string]interface{}{
+		matrixTextEvent("$1", "@alice:test", "/ping"),
+		matrixTextEvent("$2", fakeHomeserverUser, "/ping"),
+		matrixTextEvent("$3", "@alice:test", "just chatting"),
+		matrixTextEvent("$4", "@alice:test", "/addquote"),
+	}
+	useFakeHomeserver(t, hs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- glyphMatrixBot(ctx)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(hs.sentMessages()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("glyphMatrixBot returned %v after the context was canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("glyphMatrixBot did not return after the context was canceled")
+	}
+
+	sent := hs.sentMessages()
+	if len(sent) != 2 {
+		t.Fatalf("bot sent %d messages, want 2: %v", len(sent), sent)
+	}
+	want := []string{"pong", "Please write me your Quote."}
+	for i, message := range sent {
+		if message["body"] != want[i] || message["msgtype"] != "m.notice" || message["room_id"] != "!room:test" {
+			t.Errorf("message %d is %v, want notice %q in !room:test", i, message, want[i])
+		}
+	}
+	hs.mu.Lock()
+	joined := hs.joined
+	hs.mu.Unlock()
+	if len(joined) != 1 || joined[0] != "!invite:test" {
+		t.Errorf("bot joined %v, want the invited room", joined)
+	}
+}
+
+func TestGlyphMatrixAnswer(t *testing.T) {
+	useTmpStore()
+	alice := id.UserID("@alice:test")
+	steps := []struct {
+		message string
+		answer  string
+		command string
+	}{
+		{"/ping", "pong", "/ping"},
+		{"/PING now", "pong", "/ping"},
+		{"hello", "", ""},
+		{"/unknown", "", ""},
+		{"/addquote", "Please write me your Quote.", "/addquote"},
+		{"To be or not to be", "Thanks, now the author please.", ""},
+		{"Shakespeare", "Thanks, now the language please.", ""},
+		{"English", "And now the universe it comes from please:", ""},
+	}
+	for _, step := range steps {
+		answer, command := glyphMatrixAnswer(alice, step.message)
+		if answer != step.answer || command != step.command {
+			t.Errorf("glyphMatrixAnswer(%q) = %q, %q, want %q, %q", step.message, answer, command, step.answer, step.command)
+		}
+	}
+	if quote := getTmp("glyph", "matrix:@alice:test|currentQuote"); quote != "To be or not to be" {
+		t.Errorf("stored quote is %q", quote)
+	}
+	// Conversations are per user
+	if answer, _ := glyphMatrixAnswer("@bob:test", "hello"); answer != "" {
+		t.Errorf("bob got %q in alice's conversation", answer)
+	}
+}
+
+func TestGlyphMatrixSend(t *testing.T) {
+	hs := newFakeHomeserver(t)
+	useFakeHomeserver(t, hs)
+	router := gin.New()
+	router.POST("/glyph/matrix/send", glyphMatrixHandler)
+
+	send := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/glyph/matrix/send", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	tests := []struct {
+		body   string
+		status int
+		answer string
+	}{
+		{`{"roomid": "!room:test", "message": "hello"}`, http.StatusOK, ""},
+		{`{"roomid": "!room:test"}`, http.StatusBadRequest, ""},
+		{`{"roomid": "!forbidden:test", "message": "hello"}`, http.StatusBadGateway, `{"code":"M_FORBIDDEN","error":"not in the room","status":403}`},
+	}
+	for _, test := range tests {
+		w := send(test.body)
+		if w.Code != test.status {
+			t.Errorf("sending %s answered %d, want %d: %s", test.body, w.Code, test.status, w.Body.String())
+		}
+		if test.answer != "" && w.Body.String() != test.answer {
+			t.Errorf("sending %s answered %s, want %s", test.body, w.Body.String(), test.answer)
+		}
+	}
+	sent := hs.sentMessages()
+	if len(sent) != 1 || sent[0]["body"] != "hello" || sent[0]["msgtype"] != "m.text" || sent[0]["room_id"] != "!room:test" {
+		t.Errorf("homeserver received %v, want one text message", sent)
+	}
+
+	// Errors without an answer of the homeserver contain the request url, they must not reach the client
+	hs.Close()
+	w := send(`{"roomid": "!room:test", "message": "hello"}`)
+	if w.Code != http.StatusBadGateway || w.Body.String() != `{"error":"matrix unreachable"}` {
+		t.Errorf("sending to an unreachable homeserver answered %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestGlyphMatrixClientRetry(t *testing.T) {
+	hs := newFakeHomeserver(t)
+	useFakeHomeserver(t, hs)
+	config.MatrixHomeserver = "http://127.0.0.1:1"
+	if _, err := getMatrixClient(); err == nil {
+		t.Fatal("getMatrixClient succeeded with an unreachable homeserver")
+	}
+	config.MatrixHomeserver = hs.URL
+	client, err := getMatrixClient()
+	if err != nil {
+		t.Fatalf("getMatrixClient did not recover once the homeserver was reachable: %v", err)
+	}
+	if client.UserID != fakeHomeserverUser {
+		t.Errorf("client user is %s, want %s", client.UserID, fakeHomeserverUser)
+	}
+}
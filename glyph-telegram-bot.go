@@ -1,19 +1,18 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
-	"os"
-	"os/signal"
 	"strconv"
 	"strings"
-	"syscall"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/heroku/x/hmetrics/onload"
 	"github.com/keybase/go-logging"
-	UniPassauBot "github.com/tionis/uni-passau-bot/api"
 	tb "gopkg.in/tucnak/telebot.v2"
 )
 
@@ -21,26 +20,29 @@ var glyphTelegramLog = logging.MustGetLogger("glyphTelegram")
 
 const glyphTelegramContextDelay = time.Hour * 24
 
-var msgGlyph chan string
+// Admin chat that receives messages if no other chat is specified
+const glyphTelegramAdminChat = 248533143
 
-// GlyphTelegramBot handles all the legacy Glyph-Telegram-Bot code for telegram
-func glyphTelegramBot() {
+var msgGlyph = make(chan glyphTelegramOutgoingMessage)
 
-	botquit := make(chan bool) // channel for quitting of bot
+// Held by running handlers, the shutdown takes it to wait for them
+var glyphTelegramHandlers sync.RWMutex
 
-	// catch os signals like sigterm and interrupt
-	signalChannel := make(chan os.Signal, 2)
-	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		sig := <-signalChannel
-		switch sig {
-		case os.Interrupt:
-			glyphTelegramLog.Info("Interruption Signal received, shutting down...")
-			exit(botquit)
-		case syscall.SIGTERM:
-			botquit <- true
-		}
-	}()
+// glyphTelegramOutgoingMessage is a message queued for the send loop of the glyph telegram bot
+type glyphTelegramOutgoingMessage struct {
+	chatID    int64
+	text      string
+	parseMode tb.ParseMode
+	result    chan glyphTelegramSendResult
+}
+
+type glyphTelegramSendResult struct {
+	message *tb.Message
+	err     error
+}
+
+// GlyphTelegramBot handles all the legacy Glyph-Telegram-Bot code for telegram, it runs until ctx is done
+func glyphTelegramBot(ctx context.Context) error {
 
 	// Define Keyboards
 	// Define Keyboards for Quotator
@@ -51,36 +53,34 @@ func glyphTelegramBot() {
 	replyKeysLanguage := [][]tb.ReplyButton{
 		{replyBtnLanguageTopLeft, replyBtnLanguageTopRight}, {replyBtnLanguageBottomLeft, replyBtnLanguageBottomRight}}
 
-	// check for and read config variable, then create bot object
-	glyphToken := os.Getenv("TELEGRAM_TOKEN")
+	// create bot object
 	glyph, err := tb.NewBot(tb.Settings{
-		Token:  glyphToken,
+		Token:  config.TelegramToken,
 		Poller: &tb.LongPoller{Timeout: 10 * time.Second},
 	})
 	if err != nil {
-		glyphTelegramLog.Fatal(err)
-		return
+		return err
 	}
 
 	// Command Handlers
 	// handle general standard text commands
-	glyph.Handle("/hello", func(m *tb.Message) {
+	handleGlyphTelegramCommand(glyph, "/hello", func(m *tb.Message) {
 		_, _ = glyph.Send(m.Sender, "What do you want?", &tb.ReplyMarkup{ReplyKeyboardRemove: true})
 		printInfoGlyph(m)
 	})
-	glyph.Handle("/start", func(m *tb.Message) {
+	handleGlyphTelegramCommand(glyph, "/start", func(m *tb.Message) {
 		_, _ = glyph.Send(m.Sender, "Hello.", &tb.ReplyMarkup{ReplyKeyboardRemove: true})
 		printInfoGlyph(m)
 	})
-	glyph.Handle("Thanks", func(m *tb.Message) {
+	handleGlyphTelegramCommand(glyph, "Thanks", func(m *tb.Message) {
 		_, _ = glyph.Send(m.Sender, "_It's a pleasure!_", tb.ModeMarkdown)
 		printInfoGlyph(m)
 	})
-	glyph.Handle("/ping", func(m *tb.Message) {
+	handleGlyphTelegramCommand(glyph, "/ping", func(m *tb.Message) {
 		_, _ = glyph.Send(m.Sender, "_pong_", tb.ModeMarkdown)
 		printInfoGlyph(m)
 	})
-	glyph.Handle("/help", func(m *tb.Message) {
+	handleGlyphTelegramCommand(glyph, "/help", func(m *tb.Message) {
 		sendString := ""
 		if isTasadarTGAdmin(m.Sender.ID) {
 			sendString = `**Following Commands are Available:**
@@ -100,72 +100,72 @@ func glyphTelegramBot() {
 	})
 
 	// Handle Uni Passau Commands
-	glyph.Handle("/food", func(m *tb.Message) {
+	handleGlyphTelegramCommand(glyph, "/food", func(m *tb.Message) {
 		if !m.Private() {
-			_, _ = glyph.Send(m.Chat, UniPassauBot.FoodToday())
+			_, _ = glyph.Send(m.Chat, foodText(0))
 			glyphTelegramLog.Info("Group Message:")
 		} else {
-			_, _ = glyph.Send(m.Sender, UniPassauBot.FoodToday(), tb.ModeMarkdown)
+			_, _ = glyph.Send(m.Sender, foodText(0))
 		}
 		printInfoGlyph(m)
 	})
-	glyph.Handle("food", func(m *tb.Message) {
+	handleGlyphTelegramCommand(glyph, "food", func(m *tb.Message) {
 		if !m.Private() {
-			_, _ = glyph.Send(m.Chat, UniPassauBot.FoodToday())
+			_, _ = glyph.Send(m.Chat, foodText(0))
 			glyphTelegramLog.Info("Group Message:")
 		} else {
-			_, _ = glyph.Send(m.Sender, UniPassauBot.FoodToday(), tb.ModeMarkdown)
+			_, _ = glyph.Send(m.Sender, foodText(0))
 		}
 		printInfoGlyph(m)
 	})
-	glyph.Handle("/foodtoday", func(m *tb.Message) {
+	handleGlyphTelegramCommand(glyph, "/foodtoday", func(m *tb.Message) {
 		if !m.Private() {
-			_, _ = glyph.Send(m.Chat, UniPassauBot.FoodToday(), tb.ModeMarkdown)
+			_, _ = glyph.Send(m.Chat, foodText(0))
 			glyphTelegramLog.Info("Group Message:")
 		} else {
-			_, _ = glyph.Send(m.Sender, UniPassauBot.FoodToday(), tb.ModeMarkdown)
+			_, _ = glyph.Send(m.Sender, foodText(0))
 		}
 		printInfoGlyph(m)
 	})
-	glyph.Handle("/foodtomorrow", func(m *tb.Message) {
+	handleGlyphTelegramCommand(glyph, "/foodtomorrow", func(m *tb.Message) {
 		if !m.Private() {
-			_, _ = glyph.Send(m.Chat, UniPassauBot.FoodTomorrow(), tb.ModeMarkdown)
+			_, _ = glyph.Send(m.Chat, foodText(1))
 			glyphTelegramLog.Info("Group Message:")
 		} else {
-			_, _ = glyph.Send(m.Sender, UniPassauBot.FoodTomorrow(), tb.ModeMarkdown)
+			_, _ = glyph.Send(m.Sender, foodText(1))
 		}
 		printInfoGlyph(m)
 	})
-	glyph.Handle("food tomorrow", func(m *tb.Message) {
+	handleGlyphTelegramCommand(glyph, "food tomorrow", func(m *tb.Message) {
 		if !m.Private() {
-			_, _ = glyph.Send(m.Chat, UniPassauBot.FoodTomorrow(), tb.ModeMarkdown)
+			_, _ = glyph.Send(m.Chat, foodText(1))
 			glyphTelegramLog.Info("Group Message:")
 		} else {
-			_, _ = glyph.Send(m.Sender, UniPassauBot.FoodTomorrow(), tb.ModeMarkdown)
+			_, _ = glyph.Send(m.Sender, foodText(1))
 		}
 		printInfoGlyph(m)
 	})
-	glyph.Handle("/foodweek", func(m *tb.Message) {
+	handleGlyphTelegramCommand(glyph, "/foodweek", func(m *tb.Message) {
 		if !m.Private() {
-			_, _ = glyph.Send(m.Chat, UniPassauBot.FoodWeek())
+			_, _ = glyph.Send(m.Chat, foodWeekText())
 			glyphTelegramLog.Info("Group Message:")
 		} else {
-			_, _ = glyph.Send(m.Sender, UniPassauBot.FoodWeek(), tb.ModeMarkdown)
+			_, _ = glyph.Send(m.Sender, foodWeekText())
 		}
 		printInfoGlyph(m)
 	})
-	glyph.Handle("food week", func(m *tb.Message) {
+	handleGlyphTelegramCommand(glyph, "food week", func(m *tb.Message) {
 		if !m.Private() {
-			_, _ = glyph.Send(m.Chat, UniPassauBot.FoodWeek())
+			_, _ = glyph.Send(m.Chat, foodWeekText())
 			glyphTelegramLog.Info("Group Message:")
 		} else {
-			_, _ = glyph.Send(m.Sender, UniPassauBot.FoodWeek(), tb.ModeMarkdown)
+			_, _ = glyph.Send(m.Sender, foodWeekText())
 		}
 		printInfoGlyph(m)
 	})
 
 	// Handle Quotator Commands
-	glyph.Handle("/getquote", func(m *tb.Message) {
+	handleGlyphTelegramCommand(glyph, "/getquote", func(m *tb.Message) {
 		delTmp("glyph", "telegram:"+strconv.Itoa(m.Sender.ID)+"|context")
 		author, language, universe, err := parseGetQuote(strings.TrimPrefix(m.Text, "/getquote "))
 		if err != nil {
@@ -175,31 +175,21 @@ func glyphTelegramBot() {
 			_, _ = glyph.Send(m.Chat, getRandomQuote(author, language, universe), &tb.ReplyMarkup{ReplyKeyboardRemove: true})
 		}
 	})
-	glyph.Handle("/setquote", func(m *tb.Message) {
+	handleGlyphTelegramCommand(glyph, "/setquote", func(m *tb.Message) {
 		setTmp("glyph", "telegram:"+strconv.Itoa(m.Sender.ID)+"|context", "quoteRequired", glyphTelegramContextDelay)
 		_, _ = glyph.Send(m.Chat, "Please write me your Quote.", &tb.ReplyMarkup{ReplyKeyboardRemove: true})
 	})
-	glyph.Handle("/addquote", func(m *tb.Message) {
+	handleGlyphTelegramCommand(glyph, "/addquote", func(m *tb.Message) {
 		setTmp("glyph", "telegram:"+strconv.Itoa(m.Sender.ID)+"|context", "quoteRequired", glyphTelegramContextDelay)
 		_, _ = glyph.Send(m.Chat, "Please write me your Quote.", &tb.ReplyMarkup{ReplyKeyboardRemove: true})
 	})
-	glyph.Handle("/quoteoftheday", func(m *tb.Message) {
-		quote := getTmp("glyph", "telegram:"+strconv.Itoa(m.Sender.ID)+"|dayquote")
-		if quote != "" {
-			_, _ = glyph.Send(m.Chat, quote)
-		} else {
-			quote = getRandomQuote("", "", "")
-			now := time.Now()
-			year, month, day := now.Date()
-			midnight := time.Date(year, month, day+1, 0, 0, 0, 0, now.Location())
-			setTmp("glyph", "telegram:"+strconv.Itoa(m.Sender.ID)+"|dayquote", quote, time.Until(midnight))
-			_, _ = glyph.Send(m.Chat, quote)
-		}
+	handleGlyphTelegramCommand(glyph, "/quoteoftheday", func(m *tb.Message) {
+		_, _ = glyph.Send(m.Chat, quoteOfTheDay("telegram:"+strconv.Itoa(m.Sender.ID)))
 		printInfoGlyph(m)
 	})
 
 	// Handle non command text
-	glyph.Handle(tb.OnText, func(m *tb.Message) {
+	glyph.Handle(tb.OnText, trackGlyphTelegramHandler(func(m *tb.Message) {
 		context := getTmp("glyph", "telegram:"+strconv.Itoa(m.Sender.ID)+"|context")
 		if context == "" {
 			if !m.Private() {
@@ -228,46 +218,164 @@ func glyphTelegramBot() {
 			case "universeRequired":
 				setTmp("glyph", "telegram:"+strconv.Itoa(m.Sender.ID)+"|currentUniverse", m.Text, glyphTelegramContextDelay)
 				delTmp("glyph", "telegram:"+strconv.Itoa(m.Sender.ID)+"|context")
-				_, _ = glyph.Send(m.Sender, addQuote(m))
+				_, _ = glyph.Send(m.Sender, addQuote("telegram:"+strconv.Itoa(m.Sender.ID)))
 				printInfoGlyph(m)
 			default:
 				_, _ = glyph.Send(m.Sender, "Unknown Command - use help to get a list of available commands")
 			}
 
 		}
-	})
-
-	// Graceful Shutdown (botquit)
-	go func() {
-		<-botquit
-		glyph.Stop()
-		glyphTelegramLog.Info("Glyph Telegram Bot was stopped")
-		os.Exit(3)
-	}()
+	}))
 
 	// Channel for sending messages
+	sendStop := make(chan struct{})
+	sendDone := make(chan struct{})
 	go func(glyph *tb.Bot) {
-		msgGlyph = make(chan string)
+		defer close(sendDone)
 		for {
-			toSend := <-msgGlyph
-			tionis := tb.Chat{ID: 248533143}
-			_, _ = glyph.Send(&tionis, toSend, tb.ModeMarkdown)
+			select {
+			case toSend := <-msgGlyph:
+				sendQueuedGlyphTelegramMessage(glyph, toSend)
+			case <-sendStop:
+				// Send what is still waiting in the queue before stopping
+				for {
+					select {
+					case toSend := <-msgGlyph:
+						sendQueuedGlyphTelegramMessage(glyph, toSend)
+					default:
+						return
+					}
+				}
+			}
 		}
 	}(glyph)
 
+	// Once polling stopped, wait for the running handlers and send the queued messages
+	stopped := make(chan struct{})
+	defer func() {
+		atomic.StoreInt32(&glyphTelegramRunning, 0)
+		close(stopped)
+		glyphTelegramHandlers.Lock()
+		close(sendStop)
+		<-sendDone
+		glyphTelegramHandlers.Unlock()
+		glyphTelegramLog.Info("Glyph Telegram Bot was stopped")
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			glyph.Stop()
+		case <-stopped:
+		}
+	}()
+
 	// print startup message
 	glyphTelegramLog.Info("Glyph Telegram Bot was started.")
+	atomic.StoreInt32(&glyphTelegramRunning, 1)
 	glyph.Start()
+	return nil
+}
+
+func sendQueuedGlyphTelegramMessage(glyph *tb.Bot, toSend glyphTelegramOutgoingMessage) {
+	msg, err := glyph.Send(&tb.Chat{ID: toSend.chatID}, toSend.text, toSend.parseMode)
+	if err != nil {
+		glyphTelegramLog.Error("Error sending queued message to "+strconv.FormatInt(toSend.chatID, 10)+": ", err)
+	}
+	if toSend.result != nil {
+		toSend.result <- glyphTelegramSendResult{message: msg, err: err}
+	}
 }
 
 // General Telegram Glyph Logic
 
+var (
+	errGlyphTelegramNotRunning = errors.New("glyph telegram bot is not running")
+	errGlyphTelegramStalled    = errors.New("glyph telegram bot is not accepting messages")
+)
+
+// sendGlyphTelegramMessage queues a message for the send loop and waits for telegram's answer
+func sendGlyphTelegramMessage(chatID int64, text string, parseMode tb.ParseMode) (*tb.Message, error) {
+	if atomic.LoadInt32(&glyphTelegramRunning) == 0 {
+		return nil, errGlyphTelegramNotRunning
+	}
+	toSend := glyphTelegramOutgoingMessage{
+		chatID:    chatID,
+		text:      text,
+		parseMode: parseMode,
+		result:    make(chan glyphTelegramSendResult, 1),
+	}
+	select {
+	case msgGlyph <- toSend:
+	case <-time.After(10 * time.Second):
+		// The bot is running but its send loop is stuck, or it stopped meanwhile
+		return nil, errGlyphTelegramStalled
+	}
+	result := <-toSend.result
+	return result.message, result.err
+}
+
+// resolveGlyphTelegramChat resolves a chat id or one of the aliases in TELEGRAM_CHAT_ALIASES (alias=id,...)
+func resolveGlyphTelegramChat(chat string) (int64, error) {
+	chat = strings.TrimSpace(chat)
+	if chatID, err := strconv.ParseInt(chat, 10, 64); err == nil {
+		return chatID, nil
+	}
+	if strings.EqualFold(chat, "admin") {
+		return glyphTelegramAdminChat, nil
+	}
+	for _, alias := range strings.Split(config.TelegramChatAliases, ",") {
+		parts := strings.SplitN(alias, "=", 2)
+		if len(parts) != 2 || !strings.EqualFold(strings.TrimSpace(parts[0]), chat) {
+			continue
+		}
+		chatID, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid chat id for alias %s: %v", chat, err)
+		}
+		return chatID, nil
+	}
+	return 0, fmt.Errorf("unknown chat %s", chat)
+}
+
+// parseGlyphTelegramParseMode maps the parse mode names of the api to telebot parse modes
+func parseGlyphTelegramParseMode(mode string) (tb.ParseMode, error) {
+	switch strings.ToLower(mode) {
+	case "", "text", "none":
+		return tb.ModeDefault, nil
+	case "markdown":
+		return tb.ModeMarkdown, nil
+	case "markdownv2":
+		return tb.ModeMarkdownV2, nil
+	case "html":
+		return tb.ModeHTML, nil
+	default:
+		return tb.ModeDefault, fmt.Errorf("unknown parse mode %s", mode)
+	}
+}
+
+// handleGlyphTelegramCommand registers a command handler that counts its uses for the metrics
+func handleGlyphTelegramCommand(glyph *tb.Bot, command string, handler func(m *tb.Message)) {
+	glyph.Handle(command, trackGlyphTelegramHandler(func(m *tb.Message) {
+		countBotCommand("telegram", command)
+		handler(m)
+	}))
+}
+
+// trackGlyphTelegramHandler lets the shutdown wait for the handler, telebot runs handlers in their own goroutines
+func trackGlyphTelegramHandler(handler func(m *tb.Message)) func(m *tb.Message) {
+	return func(m *tb.Message) {
+		glyphTelegramHandlers.RLock()
+		defer glyphTelegramHandlers.RUnlock()
+		handler(m)
+	}
+}
+
 func printInfoGlyph(m *tb.Message) {
 	glyphTelegramLog.Info(m.Sender.Username + " - " + m.Sender.FirstName + " " + m.Sender.LastName + " - ID: " + strconv.Itoa(m.Sender.ID) + "Message: " + m.Text)
 }
 
 func isTasadarTGAdmin(ID int) bool {
-	return ID == 248533143
+	return ID == glyphTelegramAdminChat
 	/*if ID == 248533143 {
 		return true
 	}
@@ -415,11 +523,26 @@ func getRandomQuote(byAuthor, inLanguage, inUniverse string) string {
 	return quote + "\n- " + author
 }
 
-func addQuote(m *tb.Message) string {
-	quote := getTmp("glyph", "telegram:"+strconv.Itoa(m.Sender.ID)+"|currentQuote")
-	author := getTmp("glyph", "telegram:"+strconv.Itoa(m.Sender.ID)+"|currentAuthor")
-	language := strings.ToLower(getTmp("glyph", "telegram:"+strconv.Itoa(m.Sender.ID)+"|currentLanguage"))
-	universe := getTmp("glyph", "telegram:"+strconv.Itoa(m.Sender.ID)+"|currentUniverse")
+// quoteOfTheDay is a random quote that stays the same for a user until midnight
+func quoteOfTheDay(user string) string {
+	quote := getTmp("glyph", user+"|dayquote")
+	if quote != "" {
+		return quote
+	}
+	quote = getRandomQuote("", "", "")
+	now := time.Now()
+	year, month, day := now.Date()
+	midnight := time.Date(year, month, day+1, 0, 0, 0, 0, now.Location())
+	setTmp("glyph", user+"|dayquote", quote, time.Until(midnight))
+	return quote
+}
+
+// addQuote stores the quote a user entered step by step, user is the platform and id like "telegram:1234"
+func addQuote(user string) string {
+	quote := getTmp("glyph", user+"|currentQuote")
+	author := getTmp("glyph", user+"|currentAuthor")
+	language := strings.ToLower(getTmp("glyph", user+"|currentLanguage"))
+	universe := getTmp("glyph", user+"|currentUniverse")
 	stmt, err := db.Prepare(`INSERT INTO quotes (quote, author, language, universe) VALUES ($1, $2, $3, $4)`)
 	if err != nil {
 		glyphTelegramLog.Error("Error preparing database statement: ", err)
@@ -432,17 +555,3 @@ func addQuote(m *tb.Message) string {
 	}
 	return "Added quote from " + author + " to database"
 }
-
-// Stop the program and kill hanging routines
-func exit(quit chan bool) {
-	// function for normal exit
-	quit <- true
-	simpleExit()
-}
-
-// Exit while ignoring running routines
-func simpleExit() {
-	// Exit without using graceful shutdown channels
-	glyphTelegramLog.Info("Shutting down...")
-	os.Exit(0)
-}
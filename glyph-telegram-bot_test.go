@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+func TestSendGlyphTelegramMessageNotRunning(t *testing.T) {
+	start := time.Now()
+	if _, err := sendGlyphTelegramMessage(glyphTelegramAdminChat, "hello", tb.ModeDefault); err != errGlyphTelegramNotRunning {
+		t.Errorf("sending without a running bot returned %v, want %v", err, errGlyphTelegramNotRunning)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("sending without a running bot waited %v", waited)
+	}
+}
@@ -3,11 +3,19 @@ module github.com/tionis/tsdr-api
 go 1.15
 
 require (
+	github.com/BurntSushi/toml v0.4.1
 	github.com/bwmarrin/discordgo v0.23.3-0.20210506151729-0f05488fa0b3
+	github.com/gbrlsnchs/jwt/v3 v3.0.1
 	github.com/gin-gonic/gin v1.7.1
 	github.com/heroku/x v0.0.28
 	github.com/keybase/go-logging v0.0.0-20200423195923-7a5ab2ef7dec
 	github.com/lib/pq v1.10.1
 	github.com/tionis/uni-passau-bot v0.1.4
+	golang.org/x/sync v0.0.0-20190423024810-112230192c58
+	golang.org/x/text v0.3.3
 	gopkg.in/tucnak/telebot.v2 v2.3.5
+	gopkg.in/yaml.v2 v2.3.0
+	maunium.net/go/mautrix v0.9.0
 )
+
+replace github.com/tionis/uni-passau-bot => ./third_party/uni-passau-bot
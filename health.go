@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Set while the respective bot is running, read by the readiness check
+var (
+	glyphTelegramRunning int32
+	glyphDiscordRunning  int32
+	glyphMatrixSyncing   int32
+)
+
+const (
+	componentOK       = "ok"
+	componentDown     = "down"
+	componentDisabled = "disabled"
+)
+
+const healthDBPingTimeout = 2 * time.Second
+
+// healthRoutes registers the liveness and readiness checks, the states and errors of the supervised
+// subsystems are only included with subsystems as they may tell more than the public should know
+func healthRoutes(router *gin.Engine, subsystems bool) {
+	router.GET("/healthz", healthz)
+	router.GET("/readyz", readyz(subsystems))
+}
+
+// healthz only tells that the process is alive and serving requests
+func healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": componentOK})
+}
+
+// readyz reports the status of every component and fails if an enabled component is down.
+// The mensa plan is downloaded on demand, so its age is only informational, as are the states of the supervised subsystems.
+func readyz(subsystems bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		components := gin.H{
+			"database": databaseHealth(c.Request.Context()),
+			"telegram": gin.H{"status": runningStatus(config.TelegramEnabled, &glyphTelegramRunning)},
+			"discord":  discordHealth(),
+			"matrix":   gin.H{"status": runningStatus(config.MatrixEnabled, &glyphMatrixSyncing)},
+			"mensa":    mensaHealth(),
+		}
+		status := http.StatusOK
+		overall := componentOK
+		for name, component := range components {
+			if name != "mensa" && component.(gin.H)["status"] == componentDown {
+				status = http.StatusServiceUnavailable
+				overall = "degraded"
+			}
+		}
+		response := gin.H{"status": overall, "components": components}
+		if subsystems {
+			response["subsystems"] = subsystemStates()
+		}
+		c.JSON(status, response)
+	}
+}
+
+func runningStatus(enabled bool, running *int32) string {
+	if !enabled {
+		return componentDisabled
+	}
+	if atomic.LoadInt32(running) == 0 {
+		return componentDown
+	}
+	return componentOK
+}
+
+func databaseHealth(ctx context.Context) gin.H {
+	ctx, cancel := context.WithTimeout(ctx, healthDBPingTimeout)
+	defer cancel()
+	start := time.Now()
+	err := db.PingContext(ctx)
+	stats := db.Stats()
+	health := gin.H{
+		"status":           componentOK,
+		"ping_ms":          time.Since(start).Milliseconds(),
+		"open_connections": stats.OpenConnections,
+		"in_use":           stats.InUse,
+		"idle":             stats.Idle,
+		"wait_count":       stats.WaitCount,
+		"wait_duration_ms": stats.WaitDuration.Milliseconds(),
+	}
+	if err != nil {
+		apiLog.Warning("Database ping failed: ", err)
+		health["status"] = componentDown
+		health["error"] = "ping failed"
+	}
+	return health
+}
+
+// discordHealth checks the gateway connection, which only exists if the discord bot was started
+func discordHealth() gin.H {
+	if !config.DiscordEnabled {
+		return gin.H{"status": componentDisabled}
+	}
+	if atomic.LoadInt32(&glyphDiscordRunning) == 0 {
+		return gin.H{"status": componentDown}
+	}
+	session, err := getDiscordSession()
+	if err != nil {
+		return gin.H{"status": componentDown}
+	}
+	session.RLock()
+	ready := session.DataReady
+	session.RUnlock()
+	if !ready {
+		return gin.H{"status": componentDown}
+	}
+	return gin.H{"status": componentOK}
+}
+
+func mensaHealth() gin.H {
+	lastFetch := mensaCache.lastSuccessfulFetch()
+	if lastFetch.IsZero() {
+		return gin.H{"status": "never fetched"}
+	}
+	return gin.H{"status": componentOK, "last_fetch": lastFetch, "seconds_since_last_fetch": int64(time.Since(lastFetch).Seconds())}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gbrlsnchs/jwt/v3"
+	"github.com/gin-gonic/gin"
+)
+
+type tasadarToken struct {
+	jwt.Payload
+	Groups tokenGroups `json:"groups,omitempty"`
+}
+
+// tokenGroups accepts the groups claim as list or as comma separated string
+type tokenGroups []string
+
+func (g *tokenGroups) UnmarshalJSON(b []byte) error {
+	var groups []string
+	if err := json.Unmarshal(b, &groups); err == nil {
+		*g = groups
+		return nil
+	}
+	var groupString string
+	if err := json.Unmarshal(b, &groupString); err != nil {
+		return errors.New("groups claim has to be a string or a list of strings")
+	}
+	*g = nil
+	for _, group := range strings.Split(groupString, ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			*g = append(*g, group)
+		}
+	}
+	return nil
+}
+
+// Algorithms accepted for verifying jwts, configured by JWT_HS256_SECRET and JWT_ED25519_PUBLIC_KEY
+var jwtAlgorithms []jwt.Algorithm
+var jwtAlgorithmsOnce sync.Once
+
+func getJWTAlgorithms() []jwt.Algorithm {
+	jwtAlgorithmsOnce.Do(func() {
+		if secret := config.JWTHS256Secret; secret != "" {
+			jwtAlgorithms = append(jwtAlgorithms, jwt.NewHS256([]byte(secret)))
+		}
+		if key := config.JWTEd25519PublicKey; key != "" {
+			publicKey, err := parseEd25519PublicKey(key)
+			if err != nil {
+				apiLog.Error("Error parsing JWT_ED25519_PUBLIC_KEY: ", err)
+			} else {
+				jwtAlgorithms = append(jwtAlgorithms, jwt.NewEd25519(jwt.Ed25519PublicKey(publicKey)))
+			}
+		}
+		if len(jwtAlgorithms) == 0 {
+			apiLog.Warning("No JWT keys configured, all JWTs will be rejected")
+		}
+	})
+	return jwtAlgorithms
+}
+
+// parseEd25519PublicKey accepts a PEM encoded PKIX key or the base64 encoded raw key
+func parseEd25519PublicKey(key string) (ed25519.PublicKey, error) {
+	if block, _ := pem.Decode([]byte(key)); block != nil {
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		publicKey, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("key is not an ed25519 public key")
+		}
+		return publicKey, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("key has the wrong length for an ed25519 public key")
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// verifyTasadarToken checks the signature, the algorithm in the header and the claims of a jwt with all configured algorithms.
+// The exp claim is required, iss has to be JWT_ISSUER and aud has to contain JWT_AUDIENCE.
+func verifyTasadarToken(token string) (*tasadarToken, error) {
+	now := time.Now()
+	var err error = errors.New("no JWT keys configured")
+	for _, alg := range getJWTAlgorithms() {
+		var payload tasadarToken
+		_, err = jwt.Verify([]byte(token), alg, &payload, jwt.ValidateHeader, jwt.ValidatePayload(&payload.Payload,
+			jwt.ExpirationTimeValidator(now),
+			jwt.NotBeforeValidator(now),
+			jwt.IssuerValidator(config.JWTIssuer),
+			jwt.AudienceValidator(jwt.Audience{config.JWTAudience}),
+		))
+		if err == nil {
+			return &payload, nil
+		}
+	}
+	return nil, err
+}
+
+// looksLikeJWT tells api tokens and jwts apart
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// jwtAuth verifies bearer jwts and exposes the user and groups on the context.
+// Requests without a jwt are passed on unchanged.
+func jwtAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		auth := c.GetHeader("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			c.Next()
+			return
+		}
+		token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+		if !looksLikeJWT(token) {
+			c.Next()
+			return
+		}
+		payload, err := verifyTasadarToken(token)
+		if err != nil {
+			apiLog.Warning("Rejected JWT: ", err)
+			unauthorized(c)
+			return
+		}
+		c.Set("user", payload.Subject)
+		c.Set("groups", []string(payload.Groups))
+		c.Next()
+	}
+}
+
+// requireGroup only lets requests pass whose jwt has the given group, an empty group accepts every valid jwt
+func requireGroup(group string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get("user"); !ok {
+			unauthorized(c)
+			return
+		}
+		if group != "" && !inGroup(c, group) {
+			unauthorized(c)
+			return
+		}
+		c.Next()
+	}
+}
+
+// inGroup checks the groups of the jwt that authenticated the request
+func inGroup(c *gin.Context, group string) bool {
+	for _, userGroup := range c.GetStringSlice("groups") {
+		if userGroup == group {
+			return true
+		}
+	}
+	return false
+}
+
+func unauthorized(c *gin.Context) {
+	page, err := ioutil.ReadFile("static/error-pages/401.html")
+	if err != nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	c.Abort()
+	c.Data(http.StatusUnauthorized, "text/html; charset=utf-8", page)
+}
+
+func whoami(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"user": c.GetString("user"), "groups": c.GetStringSlice("groups")})
+}
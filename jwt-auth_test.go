@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gbrlsnchs/jwt/v3"
+)
+
+func TestVerifyTasadarToken(t *testing.T) {
+	previous := config
+	t.Cleanup(func() {
+		config = previous
+		jwtAlgorithms = nil
+		jwtAlgorithmsOnce = sync.Once{}
+	})
+	config.JWTHS256Secret = "test-secret"
+	config.JWTEd25519PublicKey = ""
+	config.JWTIssuer = "https://auth.tasadar.net"
+	config.JWTAudience = "api.tasadar.net"
+	jwtAlgorithms = nil
+	jwtAlgorithmsOnce = sync.Once{}
+
+	now := time.Now()
+	valid := func() jwt.Payload {
+		return jwt.Payload{
+			Subject:        "alice",
+			Issuer:         config.JWTIssuer,
+			Audience:       jwt.Audience{"other.tasadar.net", config.JWTAudience},
+			ExpirationTime: jwt.NumericDate(now.Add(time.Hour)),
+		}
+	}
+	tests := []struct {
+		name   string
+		modify func(p *jwt.Payload)
+		alg    jwt.Algorithm
+		valid  bool
+	}{
+		{"valid", func(p *jwt.Payload) {}, nil, true},
+		{"without exp", func(p *jwt.Payload) { p.ExpirationTime = nil }, nil, false},
+		{"expired", func(p *jwt.Payload) { p.ExpirationTime = jwt.NumericDate(now.Add(-time.Minute)) }, nil, false},
+		{"not yet valid", func(p *jwt.Payload) { p.NotBefore = jwt.NumericDate(now.Add(time.Hour)) }, nil, false},
+		{"other issuer", func(p *jwt.Payload) { p.Issuer = "https://evil.example.com" }, nil, false},
+		{"without issuer", func(p *jwt.Payload) { p.Issuer = "" }, nil, false},
+		{"other audience", func(p *jwt.Payload) { p.Audience = jwt.Audience{"other.tasadar.net"} }, nil, false},
+		{"without audience", func(p *jwt.Payload) { p.Audience = nil }, nil, false},
+		{"other key", func(p *jwt.Payload) {}, jwt.NewHS256([]byte("other-secret")), false},
+	}
+	for _, test := range tests {
+		payload := tasadarToken{Payload: valid(), Groups: tokenGroups{"admin"}}
+		test.modify(&payload.Payload)
+		alg := test.alg
+		if alg == nil {
+			alg = jwt.NewHS256([]byte(config.JWTHS256Secret))
+		}
+		token, err := jwt.Sign(payload, alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		verified, err := verifyTasadarToken(string(token))
+		if (err == nil) != test.valid {
+			t.Errorf("%s: verifyTasadarToken returned %v, want valid %v", test.name, err, test.valid)
+			continue
+		}
+		if test.valid && (verified.Subject != "alice" || len(verified.Groups) != 1 || verified.Groups[0] != "admin") {
+			t.Errorf("%s: verified token is %+v", test.name, verified)
+		}
+	}
+}
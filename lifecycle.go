@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Exit codes of the process
+const (
+	exitOK = 0
+	// The web server could not be started or failed
+	exitServerError = 1
+	// Not everything could be stopped cleanly before the deadline
+	exitShutdownIncomplete = 2
+	// The configuration or the command line is invalid
+	exitInvalidConfig = 3
+)
+
+// shuttingDown is closed when the shutdown begins, long running work watches it to finish early
+var shuttingDown = make(chan struct{})
+
+type shutdownHook struct {
+	name string
+	stop func(ctx context.Context) error
+}
+
+var shutdownHooks []shutdownHook
+var shutdownHooksMutex sync.Mutex
+
+// onShutdown registers a function that stops a component. All of them run concurrently once the
+// running http requests are done and have to return when ctx is done.
+// If the shutdown already began, stop is called right away.
+func onShutdown(name string, stop func(ctx context.Context) error) {
+	shutdownHooksMutex.Lock()
+	defer shutdownHooksMutex.Unlock()
+	select {
+	case <-shuttingDown:
+		go func() {
+			if err := stop(context.Background()); err != nil {
+				mainLog.Error("Error stopping "+name+": ", err)
+			}
+		}()
+	default:
+		shutdownHooks = append(shutdownHooks, shutdownHook{name: name, stop: stop})
+	}
+}
+
+// serve runs the web server until SIGINT or SIGTERM, then shuts everything down within timeout
+// and returns the exit code
+func serve(server *http.Server, timeout time.Duration) int {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	code := exitOK
+	select {
+	case sig := <-signals:
+		mainLog.Info("Received " + sig.String() + ", shutting down")
+	case err := <-serverErr:
+		mainLog.Error("Web server failed, shutting down: ", err)
+		code = exitServerError
+	}
+	// A second signal skips the rest of the shutdown
+	go func() {
+		sig := <-signals
+		mainLog.Warning("Received " + sig.String() + " again, exiting immediately")
+		os.Exit(exitShutdownIncomplete)
+	}()
+	if !shutdown(server, timeout) && code == exitOK {
+		code = exitShutdownIncomplete
+	}
+	return code
+}
+
+// shutdown drains the http requests, stops the components and closes the database.
+// It reports whether everything was stopped cleanly before the deadline.
+func shutdown(server *http.Server, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	shutdownHooksMutex.Lock()
+	close(shuttingDown)
+	hooks := shutdownHooks
+	shutdownHooksMutex.Unlock()
+	// Set by stop functions that might still run after the deadline
+	var failed int32
+
+	// The bots keep sending messages for the running requests meanwhile
+	if err := server.Shutdown(ctx); err != nil {
+		mainLog.Error("Error draining http requests: ", err)
+		failed = 1
+	}
+
+	var wg sync.WaitGroup
+	for _, hook := range hooks {
+		wg.Add(1)
+		go func(hook shutdownHook) {
+			defer wg.Done()
+			if err := hook.stop(ctx); err != nil {
+				mainLog.Error("Error stopping "+hook.name+": ", err)
+				atomic.StoreInt32(&failed, 1)
+				return
+			}
+			mainLog.Info("Stopped " + hook.name)
+		}(hook)
+	}
+	if !waitUntil(ctx, wg.Wait) {
+		mainLog.Error("Not all components stopped before the shutdown deadline")
+		atomic.StoreInt32(&failed, 1)
+	}
+
+	if !waitUntil(ctx, func() {
+		if err := db.Close(); err != nil {
+			dataLog.Error("Error closing database: ", err)
+			atomic.StoreInt32(&failed, 1)
+		}
+	}) {
+		dataLog.Error("Database was not closed before the shutdown deadline")
+		atomic.StoreInt32(&failed, 1)
+	}
+	return atomic.LoadInt32(&failed) == 0
+}
+
+// waitUntil runs f and reports whether it returned before ctx was done
+func waitUntil(ctx context.Context, f func()) bool {
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		// f might have returned just as well
+		select {
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	}
+}
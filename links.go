@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	linksDefaultLimit = 50
+	linksMaxLimit     = 500
+)
+
+var linkSlugPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Paths of static GET routes, links with these slugs would never be reached
+var reservedLinkSlugs = make(map[string]bool)
+
+type linkAPIObject struct {
+	Slug      string     `form:"slug" json:"slug"`
+	Target    string     `form:"target" json:"target" binding:"required"`
+	Code      int        `form:"code" json:"code"`
+	ExpiresAt *time.Time `form:"expires_at" json:"expires_at" time_format:"2006-01-02T15:04:05Z07:00"`
+	Clicks    int64      `form:"-" json:"clicks"`
+	CreatedAt time.Time  `form:"-" json:"created_at"`
+}
+
+// linkRoutes registers the short link resolver and its admin API, it has to be called after all other routes
+func linkRoutes(router *gin.Engine) {
+	for _, route := range router.Routes() {
+		if route.Method == http.MethodGet && !strings.ContainsAny(route.Path, ":*") {
+			reservedLinkSlugs[strings.Trim(route.Path, "/")] = true
+		}
+	}
+	router.NoRoute(resolveLink)
+
+	links := router.Group("/admin/links", requireScope("links:write"))
+	links.GET("", listLinks)
+	links.POST("", createLink)
+	links.PUT("/:slug", updateLink)
+	links.DELETE("/:slug", deleteLink)
+}
+
+// resolveLink redirects to the target of the link named by the path and counts the click
+func resolveLink(c *gin.Context) {
+	slug := strings.Trim(c.Request.URL.Path, "/")
+	if c.Request.Method != http.MethodGet || !linkSlugPattern.MatchString(slug) {
+		notFound(c)
+		return
+	}
+	var target string
+	var code int
+	err := db.QueryRow(`UPDATE links SET clicks=clicks+1 WHERE slug=$1 AND (expires_at IS NULL OR expires_at > now()) RETURNING target, code`,
+		slug).Scan(&target, &code)
+	if err == sql.ErrNoRows {
+		notFound(c)
+		return
+	} else if err != nil {
+		apiLog.Error("Error resolving link: ", err)
+		notFound(c)
+		return
+	}
+	c.Redirect(code, target)
+}
+
+// validateLink checks target and code of a link and fills in the default code
+func validateLink(link *linkAPIObject) string {
+	target, err := url.Parse(link.Target)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return "target has to be an absolute http or https url"
+	}
+	switch link.Code {
+	case 0:
+		link.Code = http.StatusFound
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return "code has to be one of 301, 302, 303, 307 or 308"
+	}
+	return ""
+}
+
+func listLinks(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(linksDefaultLimit)))
+	if err != nil || limit < 1 || limit > linksMaxLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit has to be a number between 1 and " + strconv.Itoa(linksMaxLimit)})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset has to be a positive number"})
+		return
+	}
+	rows, err := db.Query(`SELECT slug, target, code, expires_at, clicks, created_at FROM links ORDER BY slug LIMIT $1 OFFSET $2`, limit, offset)
+	if err != nil {
+		apiLog.Error("Error listing links: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	defer rows.Close()
+	links := []linkAPIObject{}
+	for rows.Next() {
+		var link linkAPIObject
+		if err := rows.Scan(&link.Slug, &link.Target, &link.Code, &link.ExpiresAt, &link.Clicks, &link.CreatedAt); err != nil {
+			apiLog.Error("Error scanning link: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			return
+		}
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		apiLog.Error("Error iterating links: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"links": links, "limit": limit, "offset": offset})
+}
+
+func createLink(c *gin.Context) {
+	var link linkAPIObject
+	if err := c.ShouldBind(&link); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !linkSlugPattern.MatchString(link.Slug) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "slug may only contain letters, digits, - and _"})
+		return
+	}
+	if reservedLinkSlugs[link.Slug] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "slug is already used by a route of the api"})
+		return
+	}
+	if message := validateLink(&link); message != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": message})
+		return
+	}
+	err := db.QueryRow(`INSERT INTO links (slug, target, code, expires_at) VALUES ($1, $2, $3, $4) ON CONFLICT (slug) DO NOTHING RETURNING created_at`,
+		link.Slug, link.Target, link.Code, link.ExpiresAt).Scan(&link.CreatedAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusConflict, gin.H{"error": "slug already exists"})
+		return
+	} else if err != nil {
+		apiLog.Error("Error creating link: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusCreated, link)
+}
+
+func updateLink(c *gin.Context) {
+	var link linkAPIObject
+	if err := c.ShouldBind(&link); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	link.Slug = c.Param("slug")
+	if message := validateLink(&link); message != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": message})
+		return
+	}
+	err := db.QueryRow(`UPDATE links SET target=$2, code=$3, expires_at=$4 WHERE slug=$1 RETURNING clicks, created_at`,
+		link.Slug, link.Target, link.Code, link.ExpiresAt).Scan(&link.Clicks, &link.CreatedAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "link not found"})
+		return
+	} else if err != nil {
+		apiLog.Error("Error updating link: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, link)
+}
+
+func deleteLink(c *gin.Context) {
+	res, err := db.Exec(`DELETE FROM links WHERE slug=$1`, c.Param("slug"))
+	if err != nil {
+		apiLog.Error("Error deleting link: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "link not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
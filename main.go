@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/heroku/x/hmetrics/onload"
@@ -13,8 +18,6 @@ import (
 
 const defaultPort = "8081"
 
-type hostSwitch map[string]http.Handler
-
 var mainLog = logging.MustGetLogger("main")
 
 var logFormat = logging.MustStringFormatter(
@@ -23,14 +26,42 @@ var logFormat = logging.MustStringFormatter(
 
 var isProduction bool
 
+var berlin *time.Location
+var berlinOnce sync.Once
+
 // Initialize Main Functions
 func main() {
+	// Errors of the bots can contain their tokens, e.g. in request urls
+	logging.SetBackend(logging.NewLogBackend(redactingWriter{os.Stderr}, "", log.LstdFlags))
 	logging.SetFormatter(logFormat)
+	var err error
+	config, err = loadConfig()
+	switch strings.Join(os.Args[1:], " ") {
+	case "", "web":
+	case "config print":
+		config.print(os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitInvalidConfig)
+		}
+		os.Exit(exitOK)
+	default:
+		fmt.Fprintln(os.Stderr, "Usage: "+os.Args[0]+" [web | config print]")
+		os.Exit(exitInvalidConfig)
+	}
+	if err != nil {
+		mainLog.Critical(err)
+		os.Exit(exitInvalidConfig)
+	}
+
 	// Initialize basic requirements
 	dbInit()
+	corsLogInit()
+	corsCacheInit()
+	corsLimitsInit()
 
 	// Detect Development Mode
-	switch strings.ToUpper(os.Getenv("MODE")) {
+	switch strings.ToUpper(config.Mode) {
 	case "PRODUCTION":
 		mainLog.Info("Detected Production Mode")
 		gin.SetMode(gin.ReleaseMode)
@@ -48,14 +79,31 @@ func main() {
 		isProduction = true
 	}
 
+	accessLogInit()
+
+	// Start the bots, the supervisor restarts them if they fail
 	// Start Uni-Passau-Bot
-	go UniPassauBot.UniPassauBot(os.Getenv("UNIPASSAUBOT_TOKEN"))
+	if config.UniPassauBotEnabled {
+		UniPassauBot.WeekSource = mensaCache.dishes
+		supervise("uni passau bot", func(ctx context.Context) error {
+			return UniPassauBot.UniPassauBot(ctx, config.UniPassauBotToken)
+		})
+	}
 
-	// Start Glyph Discord Bot // deactivated in favor of github.com/tionis/glyph
-	// go glyphDiscordBot()
+	// Start Glyph Discord Bot, disabled by default in favor of github.com/tionis/glyph
+	if config.DiscordEnabled {
+		supervise("glyph discord bot", glyphDiscordBot)
+	}
 
 	// Start Glyph Telegram Bot
-	go glyphTelegramBot()
+	if config.TelegramEnabled {
+		supervise("glyph telegram bot", glyphTelegramBot)
+	}
+
+	// Start Glyph Matrix Bot
+	if config.MatrixEnabled {
+		supervise("glyph matrix bot", glyphMatrixBot)
+	}
 
 	// Cronjob Definitions
 	// MC Cronjobs
@@ -71,54 +119,53 @@ func main() {
 	//defer c.Stop()
 
 	// Create Default gin router
-	port := os.Getenv("PORT")
+	port := config.Port
 	if port == "" {
 		mainLog.Warning("Failed to detect Port Variable, switching to default :8081")
 		port = defaultPort
 	}
-	apiRouter := gin.Default()
-	//apiRouter.Use(gin.LoggerWithFormatter(ginLogFormatter))
-	apiRouter.Use(gin.Recovery())
-	apiRoutes(apiRouter) // Initialize API Routes
-	corsRouter := gin.Default()
-	corsRoutes(corsRouter)
+	routers := make(map[string]http.Handler)
+	if config.APIEnabled {
+		apiRouter := newRouter()
+		apiRoutes(apiRouter) // Initialize API Routes
+		routers["api"] = apiRouter
+	}
+	if config.CorsEnabled {
+		corsRouter := newRouter()
+		corsRoutes(corsRouter)
+		routers["cors"] = corsRouter
+	}
+	if config.InternalEnabled {
+		internalRouter := newRouter()
+		internalRoutes(internalRouter)
+		routers["internal"] = internalRouter
+	}
 
 	// Create HostSwitch Handling for Virtual Hosts support
-	hs := make(hostSwitch)
-	if isProduction {
-		hs["api.tasadar.net"] = apiRouter
-		hs["cors.tasadar.net"] = corsRouter
-	} else {
-		hs["api.localhost:"+os.Getenv("PORT")] = apiRouter
-		hs["api.localhost"] = apiRouter
-		hs["cors.localhost:"+os.Getenv("PORT")] = corsRouter
-		hs["cors.localhost"] = corsRouter
-	}
+	hs := newHostSwitch(routers)
 
-	// Start WebServer
-	mainLog.Fatal(http.ListenAndServe(":"+os.Getenv("PORT"), hs))
+	// Start WebServer and shut everything down on SIGINT or SIGTERM
+	os.Exit(serve(&http.Server{Addr: ":" + port, Handler: hs}, config.ShutdownTimeout))
 }
 
-/*func ginLogFormatter(param gin.LogFormatterParams) string {
-	return fmt.Sprintf("%s - [%s] \"%s %s %s %d %s \"%s\" %s\"\n",
-		param.ClientIP,
-		param.TimeStamp.Format(time.RFC1123),
-		param.Method,
-		param.Path,
-		param.Request.Proto,
-		param.StatusCode,
-		param.Latency,
-		param.Request.UserAgent(),
-		param.ErrorMessage,
-	)
-}*/
-
-// Hostswitch HTTP Handler that enables the use in a standard lib way
-func (hs hostSwitch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if handler := hs[r.Host]; handler != nil {
-		handler.ServeHTTP(w, r)
-	} else {
-		// Handle host names for which no handler is registered
-		http.Error(w, "Forbidden", http.StatusForbidden)
-	}
+// newRouter creates a gin router with the access log, panic recovery and metrics
+func newRouter() *gin.Engine {
+	router := gin.New()
+	// gin would take the client ip from the first X-Forwarded-For entry, which the client controls, clientIP is used instead
+	router.ForwardedByClientIP = false
+	router.Use(accessLog(), gin.Recovery(), metricsMiddleware())
+	return router
+}
+
+// berlinLocation is the timezone of the wiki and the mensa, falling back to the local timezone if it is unavailable
+func berlinLocation() *time.Location {
+	berlinOnce.Do(func() {
+		var err error
+		berlin, err = time.LoadLocation("Europe/Berlin")
+		if err != nil {
+			mainLog.Warning("Error loading time zone Europe/Berlin, using local time: ", err)
+			berlin = time.Local
+		}
+	})
+	return berlin
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	UniPassauBot "github.com/tionis/uni-passau-bot/api"
+	"golang.org/x/sync/singleflight"
+)
+
+// mensaPlanCache keeps the plans of the weeks of the requested menu dates until midnight in Europe/Berlin,
+// weeks without food only for mensaEmptyWeekTTL as their plan may be published any time.
+// Concurrent misses share one download and expired plans are still served if the download fails.
+// It serves the mensa endpoints, the food commands of the glyph bots and those of the UniPassauBot.
+type mensaPlanCache struct {
+	fetch     func(date time.Time) ([]UniPassauBot.Dish, error)
+	mu        sync.Mutex
+	entries   map[string]*mensaCacheEntry
+	lastFetch time.Time
+	group     singleflight.Group
+
+	hits   uint64
+	misses uint64
+	stale  uint64
+	errors uint64
+}
+
+type mensaCacheEntry struct {
+	dishes  []UniPassauBot.Dish
+	expires time.Time
+}
+
+// Expired plans are kept this long to have something to serve while the studentenwerk is down
+const mensaStaleRetention = 7 * 24 * time.Hour
+
+// Plans of weeks without food, e.g. because the studentenwerk answered 404, are downloaded again after this time
+const mensaEmptyWeekTTL = 30 * time.Minute
+
+var mensaCache = newMensaPlanCache(UniPassauBot.FetchWeek)
+
+func newMensaPlanCache(fetch func(date time.Time) ([]UniPassauBot.Dish, error)) *mensaPlanCache {
+	return &mensaPlanCache{fetch: fetch, entries: make(map[string]*mensaCacheEntry)}
+}
+
+// week returns the plan of the week of date
+func (m *mensaPlanCache) week(date time.Time) (*mensaWeek, error) {
+	dishes, err := m.dishes(date)
+	if err != nil {
+		return nil, err
+	}
+	return newMensaWeekFromDishes(date, dishes), nil
+}
+
+// dishes returns the dishes of the week of date, they are shared and must not be modified
+func (m *mensaPlanCache) dishes(date time.Time) ([]UniPassauBot.Dish, error) {
+	year, week := date.ISOWeek()
+	key := strconv.Itoa(year) + "-W" + strconv.Itoa(week)
+	m.mu.Lock()
+	entry := m.entries[key]
+	m.mu.Unlock()
+	if entry != nil && time.Now().Before(entry.expires) {
+		atomic.AddUint64(&m.hits, 1)
+		return entry.dishes, nil
+	}
+	atomic.AddUint64(&m.misses, 1)
+	dishes, err, _ := m.group.Do(key, func() (interface{}, error) {
+		dishes, err := m.fetch(date)
+		if err != nil {
+			return nil, err
+		}
+		m.store(key, dishes)
+		return dishes, nil
+	})
+	if err != nil {
+		if entry != nil {
+			atomic.AddUint64(&m.stale, 1)
+			mensaLog.Warning("Serving stale mensa plan of "+key+": ", err)
+			return entry.dishes, nil
+		}
+		atomic.AddUint64(&m.errors, 1)
+		return nil, err
+	}
+	return dishes.([]UniPassauBot.Dish), nil
+}
+
+func (m *mensaPlanCache) store(key string, dishes []UniPassauBot.Dish) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	expires := mensaDate(1)
+	if len(dishes) == 0 && now.Add(mensaEmptyWeekTTL).Before(expires) {
+		expires = now.Add(mensaEmptyWeekTTL)
+	}
+	m.entries[key] = &mensaCacheEntry{dishes: dishes, expires: expires}
+	m.lastFetch = now
+	for k, entry := range m.entries {
+		if now.Sub(entry.expires) > mensaStaleRetention {
+			delete(m.entries, k)
+		}
+	}
+}
+
+// lastSuccessfulFetch is the time the plan was last downloaded, zero if it never was
+func (m *mensaPlanCache) lastSuccessfulFetch() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastFetch
+}
+
+// mensaCacheStats shows the counters of the cache
+func mensaCacheStats(c *gin.Context) {
+	mensaCache.mu.Lock()
+	entries := len(mensaCache.entries)
+	mensaCache.mu.Unlock()
+	stats := gin.H{
+		"hits":    atomic.LoadUint64(&mensaCache.hits),
+		"misses":  atomic.LoadUint64(&mensaCache.misses),
+		"stale":   atomic.LoadUint64(&mensaCache.stale),
+		"errors":  atomic.LoadUint64(&mensaCache.errors),
+		"entries": entries,
+	}
+	if lastFetch := mensaCache.lastSuccessfulFetch(); !lastFetch.IsZero() {
+		stats["last_fetch"] = lastFetch
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+// foodText is the plan of the day the given number of days from today for the bots
+func foodText(offset int) string {
+	date := mensaDate(offset)
+	week, err := mensaCache.week(date)
+	if err != nil {
+		mensaLog.Error("Error getting mensa plan: ", err)
+		return "An error occurred!"
+	}
+	return week.day(date).text()
+}
+
+// foodWeekText is the plan of the current week for the bots
+func foodWeekText() string {
+	week, err := mensaCache.week(mensaDate(0))
+	if err != nil {
+		mensaLog.Error("Error getting mensa plan: ", err)
+		return "An error occurred!"
+	}
+	return week.text()
+}
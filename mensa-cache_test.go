@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	UniPassauBot "github.com/tionis/uni-passau-bot/api"
+)
+
+func TestMensaCacheExpiry(t *testing.T) {
+	cache := newMensaPlanCache(nil)
+	date := mensaDate(0)
+
+	cache.store("empty", nil)
+	if expires := cache.entries["empty"].expires; expires.After(time.Now().Add(mensaEmptyWeekTTL)) {
+		t.Errorf("empty week expires at %v, want at most %v from now", expires, mensaEmptyWeekTTL)
+	}
+
+	cache.store("food", []UniPassauBot.Dish{{Day: date, Name: "Kaiserschmarrn"}})
+	if expires := cache.entries["food"].expires; !expires.Equal(mensaDate(1)) {
+		t.Errorf("week with food expires at %v, want at midnight %v", expires, mensaDate(1))
+	}
+}
+
+func TestMensaCacheCollapsesMisses(t *testing.T) {
+	var fetches int32
+	release := make(chan struct{})
+	cache := newMensaPlanCache(func(date time.Time) ([]UniPassauBot.Dish, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return []UniPassauBot.Dish{{Day: date, Name: "Kaiserschmarrn"}}, nil
+	})
+	date := mensaDate(0)
+
+	const requests = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			week, err := cache.week(date)
+			if err == nil && week.day(date).Dishes[0].Name != "Kaiserschmarrn" {
+				err = errors.New("wrong plan")
+			}
+			errs <- err
+		}()
+	}
+	// Let all requests miss before the download finishes
+	for atomic.LoadUint64(&cache.misses) < requests {
+		time.Sleep(time.Millisecond)
+	}
+	// and reach the shared download
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("%d concurrent misses downloaded the plan %d times, want once", requests, fetches)
+	}
+
+	if _, err := cache.week(date); err != nil || fetches != 1 || cache.hits != 1 {
+		t.Errorf("cached plan was downloaded again: %v, %d downloads, %d hits", err, fetches, cache.hits)
+	}
+}
+
+func TestMensaCacheServesStalePlan(t *testing.T) {
+	fail := errors.New("studentenwerk is down")
+	var err error
+	cache := newMensaPlanCache(func(date time.Time) ([]UniPassauBot.Dish, error) {
+		if err != nil {
+			return nil, err
+		}
+		return []UniPassauBot.Dish{{Day: date, Name: "Kaiserschmarrn"}}, nil
+	})
+	date := mensaDate(0)
+	if _, err := cache.dishes(date); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range cache.entries {
+		entry.expires = time.Now().Add(-time.Minute)
+	}
+
+	err = fail
+	dishes, got := cache.dishes(date)
+	if got != nil || len(dishes) != 1 || dishes[0].Name != "Kaiserschmarrn" {
+		t.Errorf("dishes after a failed download = %v, %v, want the stale plan", dishes, got)
+	}
+	if cache.stale != 1 {
+		t.Errorf("stale counter is %d, want 1", cache.stale)
+	}
+
+	// Without a stale plan the error is passed on
+	if _, got := cache.dishes(date.AddDate(0, 0, 7)); got != fail {
+		t.Errorf("dishes of an uncached week = %v, want %v", got, fail)
+	}
+	if cache.errors != 1 {
+		t.Errorf("error counter is %d, want 1", cache.errors)
+	}
+}
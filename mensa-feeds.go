@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/xml"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type mensaRSS struct {
+	XMLName xml.Name        `xml:"rss"`
+	Version string          `xml:"version,attr"`
+	Channel mensaRSSChannel `xml:"channel"`
+}
+
+type mensaRSSChannel struct {
+	Title         string         `xml:"title"`
+	Link          string         `xml:"link"`
+	Description   string         `xml:"description"`
+	Language      string         `xml:"language"`
+	LastBuildDate string         `xml:"lastBuildDate"`
+	Items         []mensaRSSItem `xml:"item"`
+}
+
+type mensaRSSItem struct {
+	Title       string       `xml:"title"`
+	Link        string       `xml:"link"`
+	Description string       `xml:"description"`
+	GUID        mensaRSSGUID `xml:"guid"`
+	PubDate     string       `xml:"pubDate"`
+}
+
+type mensaRSSGUID struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+}
+
+// mensaFeedDays are the days of this and, if already published, the next week that have food
+func mensaFeedDays() ([]mensaDay, error) {
+	today := mensaDate(0)
+	thisWeek, err := mensaCache.week(today)
+	if err != nil {
+		return nil, err
+	}
+	// The cached plans are shared, so they are copied before appending
+	days := append([]mensaDay{}, thisWeek.Days...)
+	nextWeek, err := mensaCache.week(today.AddDate(0, 0, 7))
+	if err != nil {
+		mensaLog.Warning("Error getting mensa plan of next week: ", err)
+	} else {
+		days = append(days, nextWeek.Days...)
+	}
+	var withFood []mensaDay
+	for _, day := range days {
+		if len(day.Dishes) > 0 {
+			withFood = append(withFood, day)
+		}
+	}
+	return withFood, nil
+}
+
+// mensaCalendar serves the plan as iCalendar with an all day event per day
+func mensaCalendar(c *gin.Context) {
+	days, err := mensaFeedDays()
+	if err != nil {
+		mensaLog.Error("Error getting mensa plan: ", err)
+		c.String(http.StatusBadGateway, "An error occurred!")
+		return
+	}
+	host := normalizeHost(c.Request.Host)
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	var b strings.Builder
+	writeICSLine(&b, "BEGIN:VCALENDAR")
+	writeICSLine(&b, "VERSION:2.0")
+	writeICSLine(&b, "PRODID:-//Tasadar//Mensa Uni Passau//DE")
+	writeICSLine(&b, "CALSCALE:GREGORIAN")
+	writeICSLine(&b, "METHOD:PUBLISH")
+	writeICSLine(&b, "X-WR-CALNAME:Mensa Uni Passau")
+	writeICSLine(&b, "X-WR-TIMEZONE:Europe/Berlin")
+	for _, day := range days {
+		writeICSLine(&b, "BEGIN:VEVENT")
+		writeICSLine(&b, "UID:mensa-"+day.day.Format("20060102")+"@"+host)
+		writeICSLine(&b, "DTSTAMP:"+stamp)
+		writeICSLine(&b, "DTSTART;VALUE=DATE:"+day.day.Format("20060102"))
+		writeICSLine(&b, "DTEND;VALUE=DATE:"+day.day.AddDate(0, 0, 1).Format("20060102"))
+		writeICSLine(&b, "SUMMARY:"+escapeICSText("Mensa: "+mensaDishNames(day)))
+		writeICSLine(&b, "DESCRIPTION:"+escapeICSText(day.text()))
+		writeICSLine(&b, "TRANSP:TRANSPARENT")
+		writeICSLine(&b, "END:VEVENT")
+	}
+	writeICSLine(&b, "END:VCALENDAR")
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", []byte(b.String()))
+}
+
+// mensaDishNames lists the main dishes of a day for the event title, all dishes if there are no main dishes
+func mensaDishNames(day mensaDay) string {
+	var names, all []string
+	for _, dish := range day.Dishes {
+		all = append(all, dish.Name)
+		if strings.HasPrefix(dish.Category, "HG") {
+			names = append(names, dish.Name)
+		}
+	}
+	if len(names) == 0 {
+		names = all
+	}
+	return strings.Join(names, ", ")
+}
+
+// writeICSLine writes a content line, folded after 75 octets without splitting utf-8 characters
+func writeICSLine(b *strings.Builder, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		// The leading space of a continuation line counts towards its length
+		limit = 74
+	}
+	b.WriteString(line + "\r\n")
+}
+
+func escapeICSText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(strings.TrimSpace(s))
+}
+
+// mensaFeed serves the plan as RSS feed with an item per day
+func mensaFeed(c *gin.Context) {
+	days, err := mensaFeedDays()
+	if err != nil {
+		mensaLog.Error("Error getting mensa plan: ", err)
+		c.String(http.StatusBadGateway, "An error occurred!")
+		return
+	}
+	link := requestBaseURL(c.Request) + "mensa/week"
+	feed := mensaRSS{Version: "2.0", Channel: mensaRSSChannel{
+		Title:         "Mensa Uni Passau",
+		Link:          link,
+		Description:   "Speiseplan der Mensa der Universität Passau",
+		Language:      "de-de",
+		LastBuildDate: time.Now().Format(time.RFC1123Z),
+	}}
+	// Newest first
+	for i := len(days) - 1; i >= 0; i-- {
+		day := days[i]
+		feed.Channel.Items = append(feed.Channel.Items, mensaRSSItem{
+			Title:       "Essen am " + day.title(),
+			Link:        link + "?format=text",
+			Description: mensaDayHTML(day),
+			GUID:        mensaRSSGUID{Value: "mensa-" + day.Date},
+			PubDate:     day.day.Format(time.RFC1123Z),
+		})
+	}
+	body, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		mensaLog.Error("Error encoding mensa feed: ", err)
+		c.String(http.StatusInternalServerError, "An error occurred!")
+		return
+	}
+	c.Data(http.StatusOK, "application/rss+xml; charset=utf-8", append([]byte(xml.Header), body...))
+}
+
+// mensaDayHTML lists the dishes of a day for feed readers
+func mensaDayHTML(day mensaDay) string {
+	var b strings.Builder
+	b.WriteString("<ul>")
+	for _, dish := range day.Dishes {
+		b.WriteString("<li><b>" + html.EscapeString(dish.Category) + "</b>: " + html.EscapeString(dish.Name))
+		if dish.Prices.Student != nil {
+			b.WriteString(" - " + html.EscapeString(formatEuro(dish.Prices.Student)))
+		}
+		b.WriteString("</li>")
+	}
+	b.WriteString("</ul>")
+	return b.String()
+}
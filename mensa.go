@@ -0,0 +1,269 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/keybase/go-logging"
+	UniPassauBot "github.com/tionis/uni-passau-bot/api"
+)
+
+var mensaLog = logging.MustGetLogger("mensa")
+
+const mimeMarkdown = "text/markdown"
+
+var mensaWeekdays = map[time.Weekday]string{
+	time.Monday:    "Montag",
+	time.Tuesday:   "Dienstag",
+	time.Wednesday: "Mittwoch",
+	time.Thursday:  "Donnerstag",
+	time.Friday:    "Freitag",
+	time.Saturday:  "Samstag",
+	time.Sunday:    "Sonntag",
+}
+
+// Prices in euro, nil if the plan has none
+type mensaPrices struct {
+	Student  *float64 `json:"student"`
+	Employee *float64 `json:"employee"`
+	Guest    *float64 `json:"guest"`
+}
+
+type mensaDish struct {
+	Category  string      `json:"category"`
+	Name      string      `json:"name"`
+	Labels    []string    `json:"labels"`
+	Allergens []string    `json:"allergens"`
+	Prices    mensaPrices `json:"prices"`
+}
+
+type mensaDay struct {
+	Date    string      `json:"date"`
+	Weekday string      `json:"weekday"`
+	Dishes  []mensaDish `json:"dishes"`
+	day     time.Time
+}
+
+type mensaWeek struct {
+	Year int        `json:"year"`
+	Week int        `json:"week"`
+	Days []mensaDay `json:"days"`
+}
+
+// mensaRoutes registers the mensa plan endpoints
+func mensaRoutes(router *gin.Engine) {
+	mensa := router.Group("/mensa")
+	mensa.GET("/today", mensaToday)
+	mensa.GET("/tomorrow", mensaTomorrow)
+	mensa.GET("/week", mensaThisWeek)
+	mensa.GET("/week.ics", mensaCalendar)
+	mensa.GET("/feed.xml", mensaFeed)
+	mensa.GET("/cache", mensaCacheStats)
+}
+
+func mensaToday(c *gin.Context) {
+	writeMensaDay(c, mensaDate(0))
+}
+
+func mensaTomorrow(c *gin.Context) {
+	writeMensaDay(c, mensaDate(1))
+}
+
+func mensaThisWeek(c *gin.Context) {
+	format, ok := mensaFormat(c)
+	if !ok {
+		return
+	}
+	week, err := mensaCache.week(mensaDate(0))
+	if err != nil {
+		writeMensaError(c, format, err)
+		return
+	}
+	writeMensa(c, format, week, week.text, week.markdown)
+}
+
+func writeMensaDay(c *gin.Context, date time.Time) {
+	format, ok := mensaFormat(c)
+	if !ok {
+		return
+	}
+	week, err := mensaCache.week(date)
+	if err != nil {
+		writeMensaError(c, format, err)
+		return
+	}
+	day := week.day(date)
+	writeMensa(c, format, day, day.text, day.markdown)
+}
+
+// mensaDate is the day the given number of days from today in Europe/Berlin
+func mensaDate(offset int) time.Time {
+	now := time.Now().In(berlinLocation())
+	return time.Date(now.Year(), now.Month(), now.Day()+offset, 0, 0, 0, 0, now.Location())
+}
+
+// mensaFormat picks the output format from ?format= or the Accept header, plain text is the default
+func mensaFormat(c *gin.Context) (string, bool) {
+	switch strings.ToLower(c.Query("format")) {
+	case "json":
+		return gin.MIMEJSON, true
+	case "text", "txt":
+		return gin.MIMEPlain, true
+	case "markdown", "md":
+		return mimeMarkdown, true
+	case "":
+		if format := c.NegotiateFormat(gin.MIMEPlain, gin.MIMEJSON, mimeMarkdown); format != "" {
+			return format, true
+		}
+		c.String(http.StatusNotAcceptable, "Supported formats are text/plain, application/json and text/markdown")
+		return "", false
+	default:
+		c.String(http.StatusBadRequest, "format has to be json, text or markdown")
+		return "", false
+	}
+}
+
+func writeMensa(c *gin.Context, format string, data interface{}, text func() string, markdown func() string) {
+	switch format {
+	case gin.MIMEJSON:
+		c.JSON(http.StatusOK, data)
+	case mimeMarkdown:
+		c.Data(http.StatusOK, mimeMarkdown+"; charset=utf-8", []byte(markdown()))
+	default:
+		c.String(http.StatusOK, text())
+	}
+}
+
+func writeMensaError(c *gin.Context, format string, err error) {
+	mensaLog.Error("Error getting mensa plan: ", err)
+	if format == gin.MIMEJSON {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "mensa plan is unavailable"})
+		return
+	}
+	c.String(http.StatusBadGateway, "An error occurred!")
+}
+
+// newMensaWeek creates the empty plan of the week of date with all workdays
+func newMensaWeek(date time.Time) *mensaWeek {
+	year, week := date.ISOWeek()
+	monday := date.AddDate(0, 0, -((int(date.Weekday()) + 6) % 7))
+	plan := &mensaWeek{Year: year, Week: week}
+	for i := 0; i < 5; i++ {
+		plan.Days = append(plan.Days, newMensaDay(monday.AddDate(0, 0, i)))
+	}
+	return plan
+}
+
+func newMensaDay(day time.Time) mensaDay {
+	return mensaDay{Date: day.Format("2006-01-02"), Weekday: day.Weekday().String(), Dishes: []mensaDish{}, day: day}
+}
+
+// newMensaWeekFromDishes sorts the dishes of the UniPassauBot plan into the days of the week of date
+func newMensaWeekFromDishes(date time.Time, dishes []UniPassauBot.Dish) *mensaWeek {
+	plan := newMensaWeek(date)
+	for _, dish := range dishes {
+		plan.add(dish.Day, mensaDish{
+			Category:  dish.Category,
+			Name:      dish.Name,
+			Labels:    dish.Labels,
+			Allergens: dish.Allergens,
+			Prices:    mensaPrices{Student: dish.Student, Employee: dish.Employee, Guest: dish.Guest},
+		})
+	}
+	return plan
+}
+
+func (w *mensaWeek) add(day time.Time, dish mensaDish) {
+	date := day.Format("2006-01-02")
+	for i := range w.Days {
+		if w.Days[i].Date == date {
+			w.Days[i].Dishes = append(w.Days[i].Dishes, dish)
+			return
+		}
+	}
+	// Weekend days are only listed if there is food
+	d := newMensaDay(day)
+	d.Dishes = append(d.Dishes, dish)
+	w.Days = append(w.Days, d)
+}
+
+// day returns the plan of date, which is empty if there is no food that day
+func (w *mensaWeek) day(date time.Time) mensaDay {
+	for _, d := range w.Days {
+		if d.Date == date.Format("2006-01-02") {
+			return d
+		}
+	}
+	return newMensaDay(date)
+}
+
+func (d mensaDay) title() string {
+	return mensaWeekdays[d.day.Weekday()] + ", " + d.day.Format("02.01.2006")
+}
+
+func (d mensaDay) text() string {
+	if len(d.Dishes) == 0 {
+		return "Kein Essen am " + d.title() + "\n"
+	}
+	var b strings.Builder
+	b.WriteString("Essen am " + d.title() + ":\n")
+	for _, dish := range d.Dishes {
+		b.WriteString(dish.Category + ": " + dish.Name)
+		if dish.Prices.Student != nil {
+			b.WriteString(" - " + formatEuro(dish.Prices.Student))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func (d mensaDay) markdown() string {
+	var b strings.Builder
+	b.WriteString("## " + d.title() + "\n\n")
+	if len(d.Dishes) == 0 {
+		b.WriteString("_Kein Essen_\n")
+		return b.String()
+	}
+	b.WriteString("| Kategorie | Gericht | Studierende | Bedienstete | Gäste |\n")
+	b.WriteString("| --- | --- | --- | --- | --- |\n")
+	for _, dish := range d.Dishes {
+		name := dish.Name
+		if len(dish.Labels) > 0 {
+			name += " _(" + strings.Join(dish.Labels, ", ") + ")_"
+		}
+		b.WriteString("| " + escapeMarkdownCell(dish.Category) + " | " + escapeMarkdownCell(name) + " | " +
+			formatEuro(dish.Prices.Student) + " | " + formatEuro(dish.Prices.Employee) + " | " + formatEuro(dish.Prices.Guest) + " |\n")
+	}
+	return b.String()
+}
+
+func (w *mensaWeek) text() string {
+	days := make([]string, 0, len(w.Days))
+	for _, d := range w.Days {
+		days = append(days, d.text())
+	}
+	return strings.Join(days, "\n")
+}
+
+func (w *mensaWeek) markdown() string {
+	days := make([]string, 0, len(w.Days))
+	for _, d := range w.Days {
+		days = append(days, d.markdown())
+	}
+	return "# Mensa KW " + strconv.Itoa(w.Week) + "\n\n" + strings.Join(days, "\n")
+}
+
+// formatEuro formats a price the german way, e.g. 2,50 €
+func formatEuro(price *float64) string {
+	if price == nil {
+		return "-"
+	}
+	return strings.Replace(strconv.FormatFloat(*price, 'f', 2, 64), ".", ",", 1) + " €"
+}
+
+func escapeMarkdownCell(s string) string {
+	return strings.ReplaceAll(s, "|", "\\|")
+}
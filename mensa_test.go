@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	UniPassauBot "github.com/tionis/uni-passau-bot/api"
+)
+
+// parseMensaCSV reads a plan like fetchMensaWeek does after the download
+func parseMensaCSV(r io.Reader, date time.Time) (*mensaWeek, error) {
+	dishes, err := UniPassauBot.ParseWeek(r, date.Location())
+	if err != nil {
+		return nil, err
+	}
+	return newMensaWeekFromDishes(date, dishes), nil
+}
+
+func TestParseMensaCSV(t *testing.T) {
+	date := time.Date(2021, time.March, 3, 0, 0, 0, 0, berlinLocation())
+	// The plan is ISO 8859-1 encoded, \xe4 is an ä
+	csv := "datum;tag;warengruppe;name;kennz;preis;stud;bed;gast\n" +
+		"01.03.2021;Mo;HG1;K\xe4sesp\xe4tzle (A,C, G);V,B;;2,50;3,50;4,50\n" +
+		"01.03.2021;Mo;N1;Apfelstrudel (A);;;1,20;abc\n" +
+		"02.03.2021;Di;HG2;Suppe\n" +
+		"06.03.2021;Sa;HG1;Pizza;;;3;4;5\n" +
+		"broken line\n" +
+		"31.02.2021;Mi;HG1;Invalid date\n"
+	plan, err := parseMensaCSV(strings.NewReader(csv), date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Year != 2021 || plan.Week != 9 {
+		t.Errorf("plan is of week %d of %d, want week 9 of 2021", plan.Week, plan.Year)
+	}
+	// The workdays and the saturday with food
+	wantDays := []string{"2021-03-01", "2021-03-02", "2021-03-03", "2021-03-04", "2021-03-05", "2021-03-06"}
+	if len(plan.Days) != len(wantDays) {
+		t.Fatalf("plan has %d days, want %d: %+v", len(plan.Days), len(wantDays), plan.Days)
+	}
+	for i, day := range plan.Days {
+		if day.Date != wantDays[i] {
+			t.Errorf("day %d is %s, want %s", i, day.Date, wantDays[i])
+		}
+	}
+
+	monday := plan.Days[0].Dishes
+	if len(monday) != 2 {
+		t.Fatalf("monday has %d dishes, want 2: %+v", len(monday), monday)
+	}
+	dish := monday[0]
+	if dish.Category != "HG1" || dish.Name != "Käsespätzle" {
+		t.Errorf("dish is %q in %q, want Käsespätzle in HG1", dish.Name, dish.Category)
+	}
+	if strings.Join(dish.Allergens, "|") != "A|C|G" || strings.Join(dish.Labels, "|") != "V|B" {
+		t.Errorf("dish has allergens %q and labels %q", dish.Allergens, dish.Labels)
+	}
+	if dish.Prices.Student == nil || *dish.Prices.Student != 2.5 || dish.Prices.Guest == nil || *dish.Prices.Guest != 4.5 {
+		t.Errorf("dish has prices %+v", dish.Prices)
+	}
+	dessert := monday[1]
+	if dessert.Name != "Apfelstrudel" || *dessert.Prices.Student != 1.2 || dessert.Prices.Employee != nil || dessert.Prices.Guest != nil {
+		t.Errorf("dessert is %+v", dessert)
+	}
+	if soup := plan.Days[1].Dishes; len(soup) != 1 || soup[0].Name != "Suppe" || soup[0].Prices.Student != nil || len(soup[0].Labels) != 0 {
+		t.Errorf("tuesday has %+v, want a soup without prices", soup)
+	}
+	if len(plan.Days[2].Dishes) != 0 {
+		t.Errorf("wednesday has %+v, want no dishes", plan.Days[2].Dishes)
+	}
+}
+
+func TestParseMensaCSVEmpty(t *testing.T) {
+	date := time.Date(2021, time.January, 1, 0, 0, 0, 0, berlinLocation())
+	plan, err := parseMensaCSV(strings.NewReader(""), date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The 1st of january 2021 is in week 53 of 2020
+	if plan.Year != 2020 || plan.Week != 53 || len(plan.Days) != 5 {
+		t.Errorf("plan of an empty file is %+v, want the empty week 53 of 2020", plan)
+	}
+	for _, day := range plan.Days {
+		if len(day.Dishes) != 0 {
+			t.Errorf("%s has %+v in the plan of an empty file", day.Date, day.Dishes)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The metrics are served in the prometheus text exposition format, version 0.0.4
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Latency buckets in seconds, the defaults of the prometheus client libraries
+var metricsLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	httpRequests = newMetricCounter("tsdr_http_requests_total",
+		"HTTP requests by virtual host, route, method and status.", "vhost", "route", "method", "status")
+	httpRequestDuration = newMetricHistogram("tsdr_http_request_duration_seconds",
+		"Latency of HTTP requests by virtual host, route and method.", metricsLatencyBuckets, "vhost", "route", "method")
+	corsUpstreamResponses = newMetricCounter("tsdr_cors_upstream_responses_total",
+		"Responses of CORS proxy upstreams by status, error if the upstream could not be reached.", "status")
+	botCommands = newMetricCounter("tsdr_bot_commands_total",
+		"Bot commands by platform and command.", "platform", "command")
+)
+
+// Commands are free text on some platforms, so only this many distinct ones get their own label
+const botCommandMaxLabels = 100
+
+var botCommandLabels = make(map[string]bool)
+var botCommandLabelsMutex sync.Mutex
+
+// metricCounter is a counter with labels
+type metricCounter struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	series map[string]*metricCounterSeries
+}
+
+type metricCounterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+func newMetricCounter(name string, help string, labels ...string) *metricCounter {
+	return &metricCounter{name: name, help: help, labels: labels, series: make(map[string]*metricCounterSeries)}
+}
+
+func (m *metricCounter) inc(labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	series := m.series[key]
+	if series == nil {
+		series = &metricCounterSeries{labelValues: labelValues}
+		m.series[key] = series
+	}
+	series.value++
+}
+
+func (m *metricCounter) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	writeMetricHeader(w, m.name, m.help, "counter")
+	for _, key := range sortedMetricKeys(m.series) {
+		series := m.series[key]
+		writeMetricSample(w, m.name, m.labels, series.labelValues, series.value)
+	}
+}
+
+// metricHistogram is a histogram with labels
+type metricHistogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*metricHistogramSeries
+}
+
+type metricHistogramSeries struct {
+	labelValues []string
+	// Counts per bucket, not cumulative
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newMetricHistogram(name string, help string, buckets []float64, labels ...string) *metricHistogram {
+	return &metricHistogram{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*metricHistogramSeries)}
+}
+
+func (m *metricHistogram) observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	series := m.series[key]
+	if series == nil {
+		series = &metricHistogramSeries{labelValues: labelValues, counts: make([]uint64, len(m.buckets))}
+		m.series[key] = series
+	}
+	if i := sort.SearchFloat64s(m.buckets, value); i < len(m.buckets) {
+		series.counts[i]++
+	}
+	series.count++
+	series.sum += value
+}
+
+func (m *metricHistogram) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	writeMetricHeader(w, m.name, m.help, "histogram")
+	labels := append(append([]string{}, m.labels...), "le")
+	for _, key := range sortedMetricKeys(m.series) {
+		series := m.series[key]
+		var cumulative uint64
+		for i, bound := range m.buckets {
+			cumulative += series.counts[i]
+			writeMetricSample(w, m.name+"_bucket", labels, append(append([]string{}, series.labelValues...), formatMetricValue(bound)), float64(cumulative))
+		}
+		writeMetricSample(w, m.name+"_bucket", labels, append(append([]string{}, series.labelValues...), "+Inf"), float64(series.count))
+		writeMetricSample(w, m.name+"_sum", m.labels, series.labelValues, series.sum)
+		writeMetricSample(w, m.name+"_count", m.labels, series.labelValues, float64(series.count))
+	}
+}
+
+func sortedMetricKeys(series interface{}) []string {
+	var keys []string
+	switch s := series.(type) {
+	case map[string]*metricCounterSeries:
+		for key := range s {
+			keys = append(keys, key)
+		}
+	case map[string]*metricHistogramSeries:
+		for key := range s {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeMetricHeader(w io.Writer, name string, help string, kind string) {
+	io.WriteString(w, "# HELP "+name+" "+strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)+"\n")
+	io.WriteString(w, "# TYPE "+name+" "+kind+"\n")
+}
+
+func writeMetricSample(w io.Writer, name string, labels []string, labelValues []string, value float64) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteString("{")
+		for i, label := range labels {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			b.WriteString(label + `="` + strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(labelValues[i]) + `"`)
+		}
+		b.WriteString("}")
+	}
+	b.WriteString(" " + formatMetricValue(value) + "\n")
+	io.WriteString(w, b.String())
+}
+
+func formatMetricValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// writeDBMetrics writes the connection pool statistics of the database
+func writeDBMetrics(w io.Writer) {
+	stats := db.Stats()
+	gauges := []struct {
+		name  string
+		help  string
+		value float64
+	}{
+		{"tsdr_db_max_open_connections", "Maximum number of open connections to the database.", float64(stats.MaxOpenConnections)},
+		{"tsdr_db_open_connections", "The number of established connections both in use and idle.", float64(stats.OpenConnections)},
+		{"tsdr_db_in_use_connections", "The number of connections currently in use.", float64(stats.InUse)},
+		{"tsdr_db_idle_connections", "The number of idle connections.", float64(stats.Idle)},
+	}
+	for _, gauge := range gauges {
+		writeMetricHeader(w, gauge.name, gauge.help, "gauge")
+		writeMetricSample(w, gauge.name, nil, nil, gauge.value)
+	}
+	counters := []struct {
+		name  string
+		help  string
+		value float64
+	}{
+		{"tsdr_db_wait_count_total", "The total number of connections waited for.", float64(stats.WaitCount)},
+		{"tsdr_db_wait_duration_seconds_total", "The total time blocked waiting for a new connection.", stats.WaitDuration.Seconds()},
+		{"tsdr_db_max_idle_closed_total", "The total number of connections closed due to SetMaxIdleConns.", float64(stats.MaxIdleClosed)},
+		{"tsdr_db_max_idle_time_closed_total", "The total number of connections closed due to SetConnMaxIdleTime.", float64(stats.MaxIdleTimeClosed)},
+		{"tsdr_db_max_lifetime_closed_total", "The total number of connections closed due to SetConnMaxLifetime.", float64(stats.MaxLifetimeClosed)},
+	}
+	for _, counter := range counters {
+		writeMetricHeader(w, counter.name, counter.help, "counter")
+		writeMetricSample(w, counter.name, nil, nil, counter.value)
+	}
+}
+
+// writeTmpStoreMetrics writes the number of entries per bucket of the RAM store
+func writeTmpStoreMetrics(w io.Writer) {
+	sizes := tmpSizes()
+	buckets := make([]string, 0, len(sizes))
+	for bucket := range sizes {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+	writeMetricHeader(w, "tsdr_tmp_store_entries", "Entries per bucket of the RAM store.", "gauge")
+	for _, bucket := range buckets {
+		writeMetricSample(w, "tsdr_tmp_store_entries", []string{"bucket"}, []string{bucket}, float64(sizes[bucket]))
+	}
+}
+
+// writeSubsystemMetrics writes the restarts and whether it is running per supervised subsystem
+func writeSubsystemMetrics(w io.Writer) {
+	subsystemsMutex.Lock()
+	sorted := append([]*subsystem{}, subsystems...)
+	subsystemsMutex.Unlock()
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+	writeMetricHeader(w, "tsdr_subsystem_up", "Whether a supervised subsystem is running.", "gauge")
+	for _, s := range sorted {
+		s.mu.Lock()
+		up := 0.0
+		if s.state == subsystemRunning {
+			up = 1
+		}
+		s.mu.Unlock()
+		writeMetricSample(w, "tsdr_subsystem_up", []string{"subsystem"}, []string{s.name}, up)
+	}
+	writeMetricHeader(w, "tsdr_subsystem_restarts_total", "Restarts of a supervised subsystem after it failed.", "counter")
+	for _, s := range sorted {
+		s.mu.Lock()
+		restarts := s.restarts
+		s.mu.Unlock()
+		writeMetricSample(w, "tsdr_subsystem_restarts_total", []string{"subsystem"}, []string{s.name}, float64(restarts))
+	}
+}
+
+// metricsMiddleware counts requests and their latency by the route pattern, so the cardinality stays bounded
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		vhost := requestVhost(c.Request)
+		method := metricMethod(c.Request.Method)
+		httpRequests.inc(vhost, route, method, strconv.Itoa(c.Writer.Status()))
+		httpRequestDuration.observe(time.Since(start).Seconds(), vhost, route, method)
+	}
+}
+
+// metricMethod is the method label of a request, clients can send any token as method so others are counted together
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "other"
+	}
+}
+
+// metrics serves all metrics in the prometheus text exposition format
+func metrics(c *gin.Context) {
+	c.Header("Content-Type", metricsContentType)
+	c.Status(http.StatusOK)
+	httpRequests.write(c.Writer)
+	httpRequestDuration.write(c.Writer)
+	corsUpstreamResponses.write(c.Writer)
+	botCommands.write(c.Writer)
+	writeDBMetrics(c.Writer)
+	writeTmpStoreMetrics(c.Writer)
+	writeSubsystemMetrics(c.Writer)
+}
+
+func countCorsUpstreamResponse(status int, err error) {
+	if err != nil {
+		corsUpstreamResponses.inc("error")
+		return
+	}
+	corsUpstreamResponses.inc(strconv.Itoa(status))
+}
+
+func countBotCommand(platform, command string) {
+	label := platform + "|" + command
+	botCommandLabelsMutex.Lock()
+	if !botCommandLabels[label] {
+		if len(botCommandLabels) >= botCommandMaxLabels {
+			command = "other"
+		} else {
+			botCommandLabels[label] = true
+		}
+	}
+	botCommandLabelsMutex.Unlock()
+	botCommands.inc(platform, command)
+}
@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestMetricMethod(t *testing.T) {
+	tests := map[string]string{
+		"GET":      "GET",
+		"OPTIONS":  "OPTIONS",
+		"PROPFIND": "other",
+		"get":      "other",
+		"":         "other",
+	}
+	for method, want := range tests {
+		if got := metricMethod(method); got != want {
+			t.Errorf("metricMethod(%q) = %q, want %q", method, got, want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	quotesDefaultLimit = 50
+	quotesMaxLimit     = 500
+)
+
+type quoteAPIObject struct {
+	ID       int    `form:"-" json:"id"`
+	Quote    string `form:"quote" json:"quote" binding:"required"`
+	Author   string `form:"author" json:"author" binding:"required"`
+	Language string `form:"language" json:"language"`
+	Universe string `form:"universe" json:"universe"`
+}
+
+// quoteRoutes registers the REST API for the Quotator quotes table
+func quoteRoutes(router *gin.Engine) {
+	quotes := router.Group("/quotes")
+	quotes.GET("", listQuotes)
+	quotes.GET("/random", randomQuote)
+	quotes.GET("/:id", getQuote)
+
+	quotesWrite := quotes.Group("", requireScope("quotes:write"))
+	quotesWrite.POST("", createQuote)
+	quotesWrite.PUT("/:id", updateQuote)
+	quotesWrite.DELETE("/:id", deleteQuote)
+}
+
+// Filters shared by the list and random endpoints, the language is stored lowercase by the bots
+func quoteFilters(c *gin.Context) (string, string, string) {
+	return c.Query("author"), strings.ToLower(c.Query("language")), c.Query("universe")
+}
+
+func listQuotes(c *gin.Context) {
+	author, language, universe := quoteFilters(c)
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(quotesDefaultLimit)))
+	if err != nil || limit < 1 || limit > quotesMaxLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit has to be a number between 1 and " + strconv.Itoa(quotesMaxLimit)})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset has to be a positive number"})
+		return
+	}
+
+	var total int
+	err = db.QueryRow(`SELECT count(*) FROM quotes WHERE (length($1)=0 OR author=$1) AND (length($2)=0 OR language=$2) AND (length($3)=0 OR universe=$3)`,
+		author, language, universe).Scan(&total)
+	if err != nil {
+		apiLog.Error("Error counting quotes: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+
+	rows, err := db.Query(`SELECT id, COALESCE(quote, ''), COALESCE(author, ''), COALESCE(language, ''), COALESCE(universe, '') FROM quotes WHERE (length($1)=0 OR author=$1) AND (length($2)=0 OR language=$2) AND (length($3)=0 OR universe=$3) ORDER BY id LIMIT $4 OFFSET $5`,
+		author, language, universe, limit, offset)
+	if err != nil {
+		apiLog.Error("Error listing quotes: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	defer rows.Close()
+	quotes := []quoteAPIObject{}
+	for rows.Next() {
+		var q quoteAPIObject
+		if err := rows.Scan(&q.ID, &q.Quote, &q.Author, &q.Language, &q.Universe); err != nil {
+			apiLog.Error("Error scanning quote: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			return
+		}
+		quotes = append(quotes, q)
+	}
+	if err := rows.Err(); err != nil {
+		apiLog.Error("Error iterating quotes: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"quotes": quotes, "total": total, "limit": limit, "offset": offset})
+}
+
+func randomQuote(c *gin.Context) {
+	author, language, universe := quoteFilters(c)
+	var q quoteAPIObject
+	err := db.QueryRow(`SELECT id, COALESCE(quote, ''), COALESCE(author, ''), COALESCE(language, ''), COALESCE(universe, '') FROM quotes WHERE (length($1)=0 OR author=$1) AND (length($2)=0 OR language=$2) AND (length($3)=0 OR universe=$3) ORDER BY RANDOM() LIMIT 1`,
+		author, language, universe).Scan(&q.ID, &q.Quote, &q.Author, &q.Language, &q.Universe)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no quote found"})
+		return
+	} else if err != nil {
+		apiLog.Error("Error getting random quote: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, q)
+}
+
+func getQuote(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid quote id"})
+		return
+	}
+	var q quoteAPIObject
+	err = db.QueryRow(`SELECT id, COALESCE(quote, ''), COALESCE(author, ''), COALESCE(language, ''), COALESCE(universe, '') FROM quotes WHERE id=$1`,
+		id).Scan(&q.ID, &q.Quote, &q.Author, &q.Language, &q.Universe)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "quote not found"})
+		return
+	} else if err != nil {
+		apiLog.Error("Error getting quote: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, q)
+}
+
+func createQuote(c *gin.Context) {
+	var q quoteAPIObject
+	if err := c.ShouldBind(&q); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	q.Language = strings.ToLower(q.Language)
+	err := db.QueryRow(`INSERT INTO quotes (quote, author, language, universe) VALUES ($1, $2, $3, $4) RETURNING id`,
+		q.Quote, q.Author, q.Language, q.Universe).Scan(&q.ID)
+	if err != nil {
+		apiLog.Error("Error creating quote: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusCreated, q)
+}
+
+func updateQuote(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid quote id"})
+		return
+	}
+	var q quoteAPIObject
+	if err := c.ShouldBind(&q); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	q.ID = id
+	q.Language = strings.ToLower(q.Language)
+	res, err := db.Exec(`UPDATE quotes SET quote=$2, author=$3, language=$4, universe=$5 WHERE id=$1`,
+		q.ID, q.Quote, q.Author, q.Language, q.Universe)
+	if err != nil {
+		apiLog.Error("Error updating quote: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "quote not found"})
+		return
+	}
+	c.JSON(http.StatusOK, q)
+}
+
+func deleteQuote(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid quote id"})
+		return
+	}
+	res, err := db.Exec(`DELETE FROM quotes WHERE id=$1`, id)
+	if err != nil {
+		apiLog.Error("Error deleting quote: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "quote not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -1,68 +1,199 @@
 package main
 
 import (
+	"crypto/subtle"
+	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"strings"
-	"time"
 
+	"github.com/bwmarrin/discordgo"
 	"github.com/gin-gonic/gin"
 	_ "github.com/heroku/x/hmetrics/onload"
 	"github.com/keybase/go-logging"
-	UniPassauBot "github.com/tionis/uni-passau-bot/api"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
 )
 
 var apiLog = logging.MustGetLogger("API")
 
-/*type tasadarToken struct {
-    jwt.Payload
-    Groups string `json:"groups,omitempty"`
-}*/
-
 type glyphDiscordMsgAPIObject struct {
 	ChannelID string `form:"channelid" json:"channelid" binding:"required"`
 	Message   string `form:"message" json:"message" binding:"required"`
-	Token     string `form:"token" json:"token" binding:"required"`
+}
+
+type glyphTelegramMsgAPIObject struct {
+	ChatID    string `form:"chatid" json:"chatid" binding:"required"`
+	Message   string `form:"message" json:"message" binding:"required"`
+	ParseMode string `form:"parsemode" json:"parsemode"`
+}
+
+type glyphMatrixMsgAPIObject struct {
+	RoomID  string `form:"roomid" json:"roomid" binding:"required"`
+	Message string `form:"message" json:"message" binding:"required"`
+}
+
+// internalRoutes serves the monitoring endpoints without authentication, it must only be reachable internally
+func internalRoutes(router *gin.Engine) {
+	router.GET("/metrics", metrics)
+	healthRoutes(router, true)
 }
 
 func apiRoutes(router *gin.Engine) {
+	// Authentication
+	router.Use(jwtAuth())
+	router.GET("/whoami", requireGroup(""), whoami)
+
 	// Default Stuff
 	router.GET("/favicon.svg", favicon)
 	router.GET("/", index)
-	router.GET("/glyph", glyphRedirect)
-	router.NoRoute(notFound)
 	router.GET("/echo", httpecho)
 
-	// Handle short links
-	router.GET("/discord", discordinvite)
-	router.GET("/log/today", logTodayRedirect)
+	// Handle wiki log
+	router.GET("/log/:when", logRedirect)
 
 	// Handle Status Watch
 	router.GET("/onlinecheck", func(c *gin.Context) {
 		c.String(418, "I'm online")
 	})
+	healthRoutes(router, false)
+	router.GET("/metrics", requireScope("metrics:read"), metrics)
 
-	// CURL API
-	router.GET("/mensa/today", retFoodToday)
-	router.GET("/mensa/tomorrow", retFoodTomorow)
-	router.GET("/mensa/week", retFoodWeek)
+	// Mensa API
+	mensaRoutes(router)
+
+	// Quotator API
+	quoteRoutes(router)
 
 	// Glyph Communication API
-	router.POST("/glyph/discord/send", glyphDiscordHandler)
-	//router.GET("/glyph/telegram/send", glyphTelegramHandler)
-	//router.GET("/glyph/matrix/send", glyphMatrixHandler)
+	router.Group("/glyph/discord", requireScope("discord:send")).POST("/send", glyphDiscordHandler)
+	router.Group("/glyph/telegram", requireScope("telegram:send")).POST("/send", glyphTelegramHandler)
+	router.Group("/glyph/matrix", requireScope("matrix:send")).POST("/send", glyphMatrixHandler)
+
+	// API Token Management
+	apiTokenRoutes(router)
+
+	// CORS Proxy Log
+	corsLogRoutes(router)
+
+	// Short Links, registered last as they take the paths no route matched
+	linkRoutes(router)
 }
 
 func glyphDiscordHandler(c *gin.Context) {
 	var messageData glyphDiscordMsgAPIObject
-	err := c.Bind(messageData) // This will infer what binder to use depending on the content-type header.
+	err := c.ShouldBind(&messageData) // This will infer what binder to use depending on the content-type header.
 	if err != nil {
 		apiLog.Error("Error while trying to bind glyph discord message:", err)
-		c.String(401, "Error in your request")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+	dg, err := getDiscordSession()
+	if err != nil {
+		apiLog.Error("Error getting discord session: ", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "discord is not available"})
+		return
+	}
+	msg, err := dg.ChannelMessageSend(messageData.ChannelID, messageData.Message)
+	if err != nil {
+		apiLog.Error("Error sending discord message: ", err)
+		response := gin.H{"error": "discord rejected the message"}
+		if restErr, ok := err.(*discordgo.RESTError); ok {
+			if restErr.Response != nil {
+				response["status"] = restErr.Response.StatusCode
+			}
+			if restErr.Message != nil {
+				response["code"] = restErr.Message.Code
+				response["error"] = restErr.Message.Message
+			}
+		}
+		c.JSON(http.StatusBadGateway, response)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": msg.ID, "channelid": msg.ChannelID})
+}
+
+func glyphTelegramHandler(c *gin.Context) {
+	var messageData glyphTelegramMsgAPIObject
+	err := c.ShouldBind(&messageData)
+	if err != nil {
+		apiLog.Error("Error while trying to bind glyph telegram message:", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+	chatID, err := resolveGlyphTelegramChat(messageData.ChatID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	c.String(200, messageData.ChannelID)
+	parseMode, err := parseGlyphTelegramParseMode(messageData.ParseMode)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	msg, err := sendGlyphTelegramMessage(chatID, messageData.Message, parseMode)
+	if err != nil {
+		if err == errGlyphTelegramNotRunning || err == errGlyphTelegramStalled {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+			return
+		}
+		// Only errors of the telegram api are passed on, others contain the request url with the bot token
+		if apiErr, ok := err.(*tb.APIError); ok {
+			c.JSON(http.StatusBadGateway, gin.H{"error": apiErr.Description, "code": apiErr.Code})
+			return
+		}
+		apiLog.Error("Error sending glyph telegram message: ", config.redact(err.Error()))
+		c.JSON(http.StatusBadGateway, gin.H{"error": "telegram unreachable"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": msg.ID, "chatid": msg.Chat.ID})
+}
+
+func glyphMatrixHandler(c *gin.Context) {
+	var messageData glyphMatrixMsgAPIObject
+	err := c.ShouldBind(&messageData)
+	if err != nil {
+		apiLog.Error("Error while trying to bind glyph matrix message:", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+	client, err := getMatrixClient()
+	if err != nil {
+		apiLog.Error("Error getting matrix client: ", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "matrix is not available"})
+		return
+	}
+	resp, err := client.SendText(id.RoomID(messageData.RoomID), messageData.Message)
+	if err != nil {
+		// Only errors of the homeserver are passed on, others contain the request url and may contain the access token
+		apiLog.Error("Error sending matrix message: ", config.redact(err.Error()))
+		if httpErr, ok := err.(mautrix.HTTPError); ok && httpErr.RespError != nil {
+			response := gin.H{"error": httpErr.RespError.Err, "code": httpErr.RespError.ErrCode}
+			if httpErr.Response != nil {
+				response["status"] = httpErr.Response.StatusCode
+			}
+			c.JSON(http.StatusBadGateway, response)
+			return
+		}
+		c.JSON(http.StatusBadGateway, gin.H{"error": "matrix unreachable"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": resp.EventID, "roomid": messageData.RoomID})
+}
+
+// isValidAPIToken checks a token against the comma separated list in API_TOKENS
+func isValidAPIToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	for _, validToken := range strings.Split(config.APITokens, ",") {
+		validToken = strings.TrimSpace(validToken)
+		if validToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(validToken)) == 1 {
+			return true
+		}
+	}
+	return false
 }
 
 // handle test case
@@ -75,78 +206,20 @@ func httpecho(c *gin.Context) {
 	c.String(200, string(requestDump))
 }
 
-func logTodayRedirect(c *gin.Context) {
-	currentTime := time.Now()
-	link := "https://wiki.tasadar.net/en/notes/log/" + currentTime.Format("2006/01/02")
-	c.Redirect(http.StatusTemporaryRedirect, link)
-}
-
 // Handle both root thingies
 func favicon(c *gin.Context) {
 	c.File("static/icons/favicon.svg")
 }
 
-func discordinvite(c *gin.Context) {
-	c.Redirect(302, "https://discord.gg/CSZyd87")
-}
-
 func index(c *gin.Context) {
 	c.File("static/index.html")
 }
 
-func glyphRedirect(c *gin.Context) {
-	c.Redirect(302, "https://discordapp.com/oauth2/authorize?client_id=635860503041802253&scope=bot&permissions=8")
-}
-
 func notFound(c *gin.Context) {
-	c.File("static/error-pages/404.html")
-}
-
-// handle simple GET requests for food
-func retFoodToday(c *gin.Context) {
-	c.String(200, UniPassauBot.FoodToday())
-}
-func retFoodTomorow(c *gin.Context) {
-	c.String(200, UniPassauBot.FoodTomorrow())
-}
-func retFoodWeek(c *gin.Context) {
-	c.String(200, UniPassauBot.FoodWeek())
-}
-
-// Handle Cors Proxy
-func corsRoutes(router *gin.Engine) {
-	router.Any("/*proxyPath", corsProxy)
-}
-
-type corsTransport http.Header
-
-func (t corsTransport) RoundTrip(r *http.Request) (*http.Response, error) {
-	resp, err := http.DefaultTransport.RoundTrip(r)
+	page, err := ioutil.ReadFile("static/error-pages/404.html")
 	if err != nil {
-		return nil, err
-	}
-	resp.Header.Set("Access-Control-Allow-Origin", "*")
-	resp.Header.Set("Access-Control-Allow-Methods", "POST, GET")
-	resp.Header.Set("Access-Control-Allow-Headers", "Content-Type")
-	return resp, nil
-}
-
-func corsProxy(c *gin.Context) {
-	if c.Param("proxyPath") == "/" {
-		c.String(200, "Just append the url(including protocol) you want to call to the domain.\nAttention: For legal reasons requests are logged!")
-	}
-	remote, err := url.Parse(strings.TrimPrefix(c.Param("proxyPath"), "/"))
-	if err != nil {
-		panic(err)
-	}
-
-	proxy := httputil.ReverseProxy{Director: func(req *http.Request) {
-		req.Header = c.Request.Header
-		req.Host = remote.Host
-		req.URL.Scheme = remote.Scheme
-		req.URL.Host = remote.Host
-		req.URL.Path = remote.Path
-	}, Transport: corsTransport(http.Header{}),
+		c.AbortWithStatus(http.StatusNotFound)
+		return
 	}
-	proxy.ServeHTTP(c.Writer, c.Request)
+	c.Data(http.StatusNotFound, "text/html; charset=utf-8", page)
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// States of a supervised subsystem
+const (
+	subsystemRunning = "running"
+	subsystemBackoff = "backoff"
+	subsystemStopped = "stopped"
+)
+
+const (
+	supervisorMinBackoff = time.Second
+	supervisorMaxBackoff = 5 * time.Minute
+	// A run that lasted this long counts as stable and resets the backoff and the flapping detection
+	supervisorStableRun = 10 * time.Minute
+	// A subsystem that failed this often within supervisorFlappingWindow is flapping
+	supervisorFlappingFailures = 5
+	supervisorFlappingWindow   = 15 * time.Minute
+)
+
+// subsystem is a long running part of the application like a bot, which is restarted when it fails
+type subsystem struct {
+	name string
+	run  func(ctx context.Context) error
+
+	mu        sync.Mutex
+	state     string
+	since     time.Time
+	restarts  int
+	lastError string
+	failures  []time.Time
+	flapping  bool
+}
+
+var subsystems []*subsystem
+var subsystemsMutex sync.Mutex
+
+// supervise runs a subsystem in the background and restarts it with exponential backoff when it returns or panics.
+// run has to block while the subsystem works and return once ctx is done, which happens on shutdown.
+func supervise(name string, run func(ctx context.Context) error) {
+	s := &subsystem{name: name, run: run, state: subsystemRunning, since: time.Now()}
+	subsystemsMutex.Lock()
+	subsystems = append(subsystems, s)
+	subsystemsMutex.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	onShutdown(name, func(shutdownCtx context.Context) error {
+		cancel()
+		select {
+		case <-done:
+			return nil
+		case <-shutdownCtx.Done():
+			return shutdownCtx.Err()
+		}
+	})
+	go s.supervise(ctx, done)
+}
+
+func (s *subsystem) supervise(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	backoff := supervisorMinBackoff
+	for {
+		s.setState(subsystemRunning)
+		start := time.Now()
+		err := s.runRecovered(ctx)
+		if ctx.Err() != nil {
+			s.setState(subsystemStopped)
+			return
+		}
+		if err == nil {
+			err = errors.New("stopped unexpectedly")
+		}
+		// The error is served by the readiness check and sent to the admin, bot tokens must not end up there
+		err = errors.New(config.redact(err.Error()))
+		if time.Since(start) >= supervisorStableRun {
+			backoff = supervisorMinBackoff
+			s.resetFailures()
+		}
+		s.failed(err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			s.setState(subsystemStopped)
+			return
+		}
+		backoff *= 2
+		if backoff > supervisorMaxBackoff {
+			backoff = supervisorMaxBackoff
+		}
+	}
+}
+
+// runRecovered runs the subsystem once and turns a panic into an error
+func (s *subsystem) runRecovered(ctx context.Context) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			mainLog.Error(s.name+" panicked: ", r, "\n", string(debug.Stack()))
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return s.run(ctx)
+}
+
+func (s *subsystem) setState(state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+	s.since = time.Now()
+}
+
+// failed records a failure and reports the subsystem once it starts flapping
+func (s *subsystem) failed(err error, backoff time.Duration) {
+	now := time.Now()
+	s.mu.Lock()
+	s.state = subsystemBackoff
+	s.since = now
+	s.restarts++
+	s.lastError = err.Error()
+	recent := s.failures[:0]
+	for _, failure := range s.failures {
+		if now.Sub(failure) < supervisorFlappingWindow {
+			recent = append(recent, failure)
+		}
+	}
+	s.failures = append(recent, now)
+	startedFlapping := !s.flapping && len(s.failures) >= supervisorFlappingFailures
+	if startedFlapping {
+		s.flapping = true
+	}
+	failures := len(s.failures)
+	s.mu.Unlock()
+
+	mainLog.Error(s.name+" failed, restarting in "+backoff.String()+": ", err)
+	if startedFlapping {
+		message := s.name + " is flapping, it failed " + strconv.Itoa(failures) + " times in the last " +
+			supervisorFlappingWindow.String() + ". Last error: " + err.Error()
+		mainLog.Warning(message)
+		notifyAdmin(message)
+	}
+}
+
+func (s *subsystem) resetFailures() {
+	s.mu.Lock()
+	wasFlapping := s.flapping
+	s.failures = nil
+	s.flapping = false
+	s.mu.Unlock()
+	if wasFlapping {
+		mainLog.Info(s.name + " is stable again")
+	}
+}
+
+// notifyAdmin sends a message to the admin chat of the glyph telegram bot without waiting for it
+func notifyAdmin(message string) {
+	message = config.redact(message)
+	go func() {
+		if _, err := sendGlyphTelegramMessage(glyphTelegramAdminChat, message, tb.ModeDefault); err != nil {
+			mainLog.Error("Error notifying the admin: ", err)
+		}
+	}()
+}
+
+// subsystemStates describes the state of every supervised subsystem
+func subsystemStates() gin.H {
+	subsystemsMutex.Lock()
+	defer subsystemsMutex.Unlock()
+	states := gin.H{}
+	for _, s := range subsystems {
+		s.mu.Lock()
+		state := gin.H{
+			"state":    s.state,
+			"since":    s.since,
+			"restarts": s.restarts,
+			"flapping": s.flapping,
+		}
+		if s.lastError != "" {
+			state["last_error"] = s.lastError
+		}
+		s.mu.Unlock()
+		states[s.name] = state
+	}
+	return states
+}
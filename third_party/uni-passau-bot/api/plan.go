@@ -0,0 +1,123 @@
+package api
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// The studentenwerk publishes the plan of the mensa of the university of passau as csv file per iso week
+const planURL = "https://www.stwno.de/infomax/daten-extern/csv/UNI-P/"
+
+// Only this much of a plan is read
+const maxPlanSize = 1 << 20
+
+var planClient = &http.Client{Timeout: 15 * time.Second}
+
+// Allergens and additives are listed in brackets after the name of a dish
+var allergensPattern = regexp.MustCompile(`\(([^)]*)\)`)
+
+// Dish is a dish of the mensa plan, the prices in euro are nil if the plan has none
+type Dish struct {
+	Day       time.Time
+	Category  string
+	Name      string
+	Labels    []string
+	Allergens []string
+	Student   *float64
+	Employee  *float64
+	Guest     *float64
+}
+
+// WeekSource provides the dishes of the week of a date to the food commands, it can be replaced e.g. by a cache
+var WeekSource = FetchWeek
+
+// FetchWeek downloads the plan of the iso week of date, the days are in the location of date.
+// A week without a published plan has no dishes.
+func FetchWeek(date time.Time) ([]Dish, error) {
+	year, week := date.ISOWeek()
+	resp, err := planClient.Get(planURL + strconv.Itoa(week) + ".csv")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return ParseWeek(io.LimitReader(resp.Body, maxPlanSize), date.Location())
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, errors.New("unexpected status " + resp.Status + " for week " + strconv.Itoa(week) + " of " + strconv.Itoa(year))
+	}
+}
+
+// ParseWeek parses the ISO 8859-1 encoded, semicolon separated plan with the columns
+// datum;tag;warengruppe;name;kennz;preis;stud;bed;gast
+func ParseWeek(r io.Reader, loc *time.Location) ([]Dish, error) {
+	reader := csv.NewReader(charmap.ISO8859_1.NewDecoder().Reader(r))
+	reader.Comma = ';'
+	reader.LazyQuotes = true
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var dishes []Dish
+	for _, record := range records {
+		if len(record) < 4 {
+			continue
+		}
+		day, err := time.ParseInLocation("02.01.2006", strings.TrimSpace(record[0]), loc)
+		if err != nil {
+			// The header and broken lines
+			continue
+		}
+		dish := Dish{
+			Day:       day,
+			Category:  strings.TrimSpace(record[2]),
+			Name:      strings.Join(strings.Fields(allergensPattern.ReplaceAllString(record[3], " ")), " "),
+			Labels:    []string{},
+			Allergens: []string{},
+		}
+		for _, allergens := range allergensPattern.FindAllStringSubmatch(record[3], -1) {
+			dish.Allergens = append(dish.Allergens, splitList(allergens[1])...)
+		}
+		if len(record) > 4 {
+			dish.Labels = append(dish.Labels, splitList(record[4])...)
+		}
+		dish.Student = parsePrice(record, 6)
+		dish.Employee = parsePrice(record, 7)
+		dish.Guest = parsePrice(record, 8)
+		dishes = append(dishes, dish)
+	}
+	return dishes, nil
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parsePrice parses a price like "2,50" from the given column
+func parsePrice(record []string, column int) *float64 {
+	if len(record) <= column {
+		return nil
+	}
+	price, err := strconv.ParseFloat(strings.Replace(strings.TrimSpace(record[column]), ",", ".", 1), 64)
+	if err != nil {
+		return nil
+	}
+	return &price
+}
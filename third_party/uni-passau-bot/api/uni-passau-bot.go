@@ -0,0 +1,285 @@
+package api
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// Use this for heroku metrics
+	_ "github.com/heroku/x/hmetrics/onload"
+	"github.com/keybase/go-logging"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+var mensaBotLog = logging.MustGetLogger("mensaBot")
+
+var initOnce sync.Once
+
+// UniPassauBot takes a telegram token and runs the uni passau bot on this bot account until ctx is done.
+// The RAM store is only initialized on the first start, so the bot can be restarted.
+func UniPassauBot(ctx context.Context, token string) error {
+	initOnce.Do(dbInit)
+
+	// create bot object
+	b, err := tb.NewBot(tb.Settings{
+		Token:  token,
+		Poller: &tb.LongPoller{Timeout: 10 * time.Second},
+	})
+	if err != nil {
+		return err
+	}
+
+	// init reply keyboard
+	replyBtn := tb.ReplyButton{Text: "Food for today"}
+	replyBtn2 := tb.ReplyButton{Text: "Food for tomorrow"}
+	replyBtn3 := tb.ReplyButton{Text: "Food for the week"}
+	replyKeys := [][]tb.ReplyButton{
+		{replyBtn, replyBtn2}, {replyBtn3}}
+
+	// Command Handlers
+	// handle special keyboard commands
+	b.Handle(&replyBtn, func(m *tb.Message) {
+		if getTmp("uni-passau-bot", "isCorona") != "true" {
+			_, _ = b.Send(m.Sender, FoodToday(), &tb.ReplyMarkup{ReplyKeyboard: replyKeys}, tb.ModeMarkdown)
+		} else {
+			_, _ = b.Send(m.Chat, "Sorry, it's Corona time! 😔")
+		}
+		printInfo(m)
+	})
+	b.Handle(&replyBtn2, func(m *tb.Message) {
+		if getTmp("uni-passau-bot", "isCorona") != "true" {
+			_, _ = b.Send(m.Sender, FoodTomorrow(), &tb.ReplyMarkup{ReplyKeyboard: replyKeys}, tb.ModeMarkdown)
+		} else {
+			_, _ = b.Send(m.Chat, "Sorry, it's Corona time! 😔")
+		}
+		printInfo(m)
+	})
+	b.Handle(&replyBtn3, func(m *tb.Message) {
+		if getTmp("uni-passau-bot", "isCorona") != "true" {
+			_, _ = b.Send(m.Sender, FoodWeek(), &tb.ReplyMarkup{ReplyKeyboard: replyKeys}, tb.ModeMarkdown)
+		} else {
+			_, _ = b.Send(m.Chat, "Sorry, it's Corona time! 😔")
+		}
+		printInfo(m)
+	})
+	// handle standard text commands
+	b.Handle("/hello", func(m *tb.Message) {
+		_, _ = b.Send(m.Sender, "Hi! How are you?", tb.ModeMarkdown)
+		printInfo(m)
+	})
+	b.Handle("/start", func(m *tb.Message) {
+		_, _ = b.Send(m.Sender, "Hallo! Ich bin der inoffizielle ChatBot der Uni Passau! Was kann ich dir Gutes tun?\nWenn du Hilfe benötigst benutze einfach /help!\nSolltest du den Mensa- und Stundenplan in einer App wollen, schreibe /app für mehr Informationen", &tb.ReplyMarkup{ReplyKeyboard: replyKeys})
+		printInfo(m)
+	})
+	b.Handle("/app", func(m *tb.Message) {
+		_, _ = b.Send(m.Sender, "Du kannst dir die Android-App im [Play Store](https://play.google.com/store/apps/details?id=studip_uni_passau.femtopedia.de.unipassaustudip) gratis herunterladen.\nHinweis: Diese App wird von einer anderen Person entwickelt, bitte kontaktiere den App-Entwickler für Support!", tb.ModeMarkdown)
+		printInfo(m)
+
+	})
+	b.Handle("/help", func(m *tb.Message) {
+		_, _ = b.Send(m.Sender, "Information about the Bot is in the Description\nAvailable Commands are:\n*/help* - Show this help\n*/food* - Get Information for the food TODAY in the Uni Passau\n*/foodtomorrow* - Get Information for the food TOMORROW in the Uni Passau\n*/foodweek* - Get Information for the wood this WEEK in the Uni Passau\n*/contact* - Contact the bot maintainer for requests and bug reports\n*/app* - More Information for an useful Android-App for studip", tb.ModeMarkdown)
+		printInfo(m)
+	})
+	b.Handle("/food", func(m *tb.Message) {
+		if getTmp("uni-passau-bot", "isCorona") != "true" {
+			if !m.Private() {
+				_, _ = b.Send(m.Chat, FoodToday())
+				mensaBotLog.Info("Group Message:")
+			} else {
+				_, _ = b.Send(m.Sender, FoodToday(), &tb.ReplyMarkup{ReplyKeyboard: replyKeys}, tb.ModeMarkdown)
+			}
+		} else {
+			_, _ = b.Send(m.Chat, "Sorry, it's Corona time! 😔")
+		}
+		printInfo(m)
+		//printAnswer(foodtoday())
+	})
+	b.Handle("/foodtomorrow", func(m *tb.Message) {
+		if getTmp("uni-passau-bot", "isCorona") != "true" {
+			if !m.Private() {
+				_, _ = b.Send(m.Chat, FoodTomorrow())
+				mensaBotLog.Info("Group Message:")
+			} else {
+				_, _ = b.Send(m.Sender, FoodTomorrow(), &tb.ReplyMarkup{ReplyKeyboard: replyKeys}, tb.ModeMarkdown)
+			}
+		} else {
+			_, _ = b.Send(m.Chat, "Sorry, it's Corona time! 😔")
+		}
+		printInfo(m)
+	})
+	b.Handle("/foodweek", func(m *tb.Message) {
+		if getTmp("uni-passau-bot", "isCorona") != "true" {
+			if !m.Private() {
+				_, _ = b.Send(m.Chat, FoodWeek())
+				//_, _ = b.Send(m.Chat, "This command is temporarily disabled.")
+				mensaBotLog.Info("Group Message:")
+			} else {
+				_, _ = b.Send(m.Sender, FoodWeek(), &tb.ReplyMarkup{ReplyKeyboard: replyKeys}, tb.ModeMarkdown)
+				//_, _ = b.Send(m.Sender, "This command is temporarily disabled.")
+			}
+		} else {
+			_, _ = b.Send(m.Chat, "Sorry, it's Corona time! 😔")
+		}
+		printInfo(m)
+	})
+	b.Handle("/contact", func(m *tb.Message) {
+		sendstring := ""
+		if m.Text == "/contact" {
+			_, _ = b.Send(m.Sender, "For requests and bug reports just add your message to the _/contact_ command.", tb.ModeMarkdown)
+		} else {
+			_, _ = b.Send(m.Sender, "Sending Message to the Bot Maintainer...")
+			tionis := tb.Chat{ID: 248533143}
+			sendstring = "Message by " + m.Sender.FirstName + " " + m.Sender.LastName + "\nID: " + strconv.Itoa(m.Sender.ID) + " Username: " + m.Sender.Username + "\n- - - - -\n" + strings.TrimPrefix(m.Text, "/contact ")
+			_, _ = b.Send(&tionis, sendstring)
+		}
+		printInfo(m)
+		printAnswer(sendstring)
+	})
+	b.Handle("/send", func(m *tb.Message) {
+		if m.Sender.ID == 248533143 {
+			s1 := strings.TrimPrefix(m.Text, "/send ")
+			s := strings.Split(s1, "$")
+			recID, _ := strconv.ParseInt(s[0], 10, 64)
+			rec := tb.Chat{ID: recID}
+			_, _ = b.Send(&rec, s[1])
+		} else {
+			_, _ = b.Send(m.Sender, "You are not authorized to execute this command!")
+			printInfo(m)
+		}
+	})
+	b.Handle("Danke", func(m *tb.Message) {
+		_, _ = b.Send(m.Sender, "_Gern geschehen!_", tb.ModeMarkdown)
+		printInfo(m)
+		printAnswer("_Gern geschehen!_")
+	})
+	b.Handle("Thanks", func(m *tb.Message) {
+		_, _ = b.Send(m.Sender, "_It's a pleasure!_", tb.ModeMarkdown)
+		printInfo(m)
+		printAnswer("_It's a pleasure!_")
+	})
+	b.Handle("/ping", func(m *tb.Message) {
+		_, _ = b.Send(m.Sender, "_pong_", tb.ModeMarkdown)
+		printInfo(m)
+		printAnswer("_pong_")
+	})
+	b.Handle(tb.OnAddedToGroup, func(m *tb.Message) {
+		mensaBotLog.Info("Group Message:")
+		printInfo(m)
+	})
+	b.Handle(tb.OnText, func(m *tb.Message) {
+		sendstring := "Unknown Command - use help to get a list of available commands"
+		if !m.Private() {
+			mensaBotLog.Info("Message from Group:")
+		} else {
+			_, _ = b.Send(m.Sender, sendstring)
+		}
+		printInfo(m)
+		printAnswer(sendstring)
+	})
+
+	// Graceful Shutdown
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			b.Stop()
+			mensaBotLog.Info("Bot was stopped")
+		case <-stopped:
+		}
+	}()
+
+	// print startup message
+	mensaBotLog.Info("Starting up...")
+	b.Start()
+	return nil
+}
+
+// FoodToday return a string of todays food
+func FoodToday() string {
+	return foodDay(0, "heute")
+}
+
+// FoodTomorrow returns a string for the food tomorrow
+func FoodTomorrow() string {
+	return foodDay(1, "morgen")
+}
+
+// FoodWeek returns a string of the food for the week
+func FoodWeek() string {
+	today := berlinToday()
+	monday := today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+	dishes, err := WeekSource(today)
+	if err != nil {
+		mensaBotLog.Error("Could not get food for the week: ", err)
+		return "An error occurred!"
+	}
+	days := make([]string, 0, 5)
+	for i := 0; i < 5; i++ {
+		day := monday.AddDate(0, 0, i)
+		days = append(days, "*"+weekdays[day.Weekday()]+"*:\n"+dishLines(dishes, day))
+	}
+	return strings.Join(days, "\n")
+}
+
+var weekdays = map[time.Weekday]string{
+	time.Monday:    "Montag",
+	time.Tuesday:   "Dienstag",
+	time.Wednesday: "Mittwoch",
+	time.Thursday:  "Donnerstag",
+	time.Friday:    "Freitag",
+	time.Saturday:  "Samstag",
+	time.Sunday:    "Sonntag",
+}
+
+// foodDay returns the food of the day the given number of days from today, which is called when in the answer
+func foodDay(offset int, when string) string {
+	day := berlinToday().AddDate(0, 0, offset)
+	if day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+		return "_Kein Essen " + when + "!_ 😩"
+	}
+	dishes, err := WeekSource(day)
+	if err != nil {
+		mensaBotLog.Error("Could not get food for "+day.Format("02.01.2006")+": ", err)
+		return "An error occurred!"
+	}
+	return "*Essen am " + weekdays[day.Weekday()] + ":* 😋\n" + dishLines(dishes, day)
+}
+
+// dishLines lists the dishes of day with their price for students
+func dishLines(dishes []Dish, day time.Time) string {
+	var b strings.Builder
+	for _, dish := range dishes {
+		if dish.Day.Format("2006-01-02") != day.Format("2006-01-02") {
+			continue
+		}
+		b.WriteString(dish.Category + ": " + dish.Name)
+		if dish.Student != nil {
+			b.WriteString(" - " + strings.Replace(strconv.FormatFloat(*dish.Student, 'f', 2, 64), ".", ",", 1) + " €")
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// berlinToday is the start of today in Europe/Berlin, falling back to the local timezone if it is unavailable
+func berlinToday() time.Time {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		loc = time.Local
+	}
+	now := time.Now().In(loc)
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+}
+
+// Print info regarding a given message
+func printInfo(m *tb.Message) {
+	mensaBotLog.Info("[UniPassauBot] " + m.Sender.Username + " - " + m.Sender.FirstName + " " + m.Sender.LastName + " - ID: " + strconv.Itoa(m.Sender.ID) + "Message: " + m.Text + "\n")
+}
+
+// Answer wrapper
+func printAnswer(input string) {
+	mensaBotLog.Info("[UniPassauBot] Answer: " + input)
+}
@@ -0,0 +1,11 @@
+module github.com/tionis/uni-passau-bot
+
+go 1.14
+
+require (
+	github.com/heroku/x v0.0.25
+	github.com/jinzhu/now v1.1.1
+	github.com/keybase/go-logging v0.0.0-20200423195923-7a5ab2ef7dec
+	golang.org/x/text v0.3.3
+	gopkg.in/tucnak/telebot.v2 v2.3.3
+)
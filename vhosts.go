@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// hostSwitch routes requests to the router of their virtual host
+type hostSwitch struct {
+	hosts map[string]http.Handler
+	// Subdomain patterns, longest suffix first so the most specific one wins
+	wildcards   []hostSwitchWildcard
+	defaultHost http.Handler
+}
+
+type hostSwitchWildcard struct {
+	suffix  string
+	handler http.Handler
+}
+
+// vhostContextKey holds the matched virtual host pattern in the request context
+type vhostContextKey struct{}
+
+// Virtual hosts used if VHOSTS is not set
+const (
+	productionVhosts = "api.tasadar.net=api,cors.tasadar.net=cors"
+	debugVhosts      = "api.localhost=api,cors.localhost=cors,internal.localhost=internal"
+)
+
+// newHostSwitch builds the virtual host table from VHOSTS (e.g. "api.example.com=api,*.cors.example.com=cors")
+// and DEFAULT_VHOST, which names the router for unknown hosts. Routers are referenced by their name in routers,
+// the default virtual hosts of disabled routers are left out.
+func newHostSwitch(routers map[string]http.Handler) *hostSwitch {
+	spec := config.Vhosts
+	defaults := spec == ""
+	if defaults {
+		spec = debugVhosts
+		if isProduction {
+			spec = productionVhosts
+		}
+	}
+	hs := &hostSwitch{hosts: make(map[string]http.Handler)}
+	for _, vhost := range strings.Split(spec, ",") {
+		vhost = strings.TrimSpace(vhost)
+		if vhost == "" {
+			continue
+		}
+		parts := strings.SplitN(vhost, "=", 2)
+		if len(parts) != 2 {
+			mainLog.Fatal("Invalid virtual host in VHOSTS, expected host=router: ", vhost)
+		}
+		host := normalizeHost(parts[0])
+		name := strings.TrimSpace(parts[1])
+		handler := routers[name]
+		if defaults && handler == nil {
+			continue
+		}
+		if host == "" || handler == nil {
+			mainLog.Fatal("Invalid virtual host in VHOSTS, unknown router or empty host: ", vhost)
+		}
+		if strings.HasPrefix(host, "*.") {
+			hs.wildcards = append(hs.wildcards, hostSwitchWildcard{suffix: host[1:], handler: handler})
+		} else {
+			hs.hosts[host] = handler
+		}
+		mainLog.Info("Serving " + host + " with the " + name + " router")
+	}
+	sort.SliceStable(hs.wildcards, func(i, j int) bool {
+		return len(hs.wildcards[i].suffix) > len(hs.wildcards[j].suffix)
+	})
+	if name := config.DefaultVhost; name != "" {
+		hs.defaultHost = routers[name]
+		if hs.defaultHost == nil {
+			mainLog.Fatal("Unknown router in DEFAULT_VHOST: ", name)
+		}
+	}
+	return hs
+}
+
+// normalizeHost strips the port and a trailing dot and lowercases the host
+func normalizeHost(host string) string {
+	host = strings.TrimSpace(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// handler finds the router for a host, it is nil if neither a host nor the default matches.
+// The label is the matching pattern of VHOSTS or "default", so it stays bounded for metrics and logs.
+func (hs *hostSwitch) handler(host string) (http.Handler, string) {
+	host = normalizeHost(host)
+	if handler := hs.hosts[host]; handler != nil {
+		return handler, host
+	}
+	for _, wildcard := range hs.wildcards {
+		if strings.HasSuffix(host, wildcard.suffix) {
+			return wildcard.handler, "*" + wildcard.suffix
+		}
+	}
+	return hs.defaultHost, "default"
+}
+
+// requestVhost is the virtual host pattern the request was routed by
+func requestVhost(r *http.Request) string {
+	if vhost, ok := r.Context().Value(vhostContextKey{}).(string); ok {
+		return vhost
+	}
+	return "none"
+}
+
+// Hostswitch HTTP Handler that enables the use in a standard lib way
+func (hs *hostSwitch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handler, vhost := hs.handler(r.Host); handler != nil {
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), vhostContextKey{}, vhost)))
+	} else {
+		// Handle host names for which no handler is registered
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	}
+}
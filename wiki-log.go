@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultWikiLogURLTemplate = "https://wiki.tasadar.net/en/notes/log/{year}/{month}/{day}"
+
+// Relative dates are limited to about a hundred years
+const wikiLogMaxOffset = 36500
+
+// logRedirect redirects to the wiki log page of a day given as today, yesterday, tomorrow,
+// YYYY-MM-DD or a relative number of days like -3 or +1, or to the page of the current week
+func logRedirect(c *gin.Context) {
+	when := c.Param("when")
+	now := time.Now().In(berlinLocation())
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if when == "week" {
+		c.Redirect(http.StatusTemporaryRedirect, wikiLogWeekURL(today))
+		return
+	}
+	day, ok := parseLogDay(when, today)
+	if !ok {
+		notFound(c)
+		return
+	}
+	c.Redirect(http.StatusTemporaryRedirect, wikiLogURL(config.WikiLogURLTemplate, day))
+}
+
+// parseLogDay resolves the day a log link refers to relative to today
+func parseLogDay(when string, today time.Time) (time.Time, bool) {
+	switch when {
+	case "today":
+		return today, true
+	case "yesterday":
+		return today.AddDate(0, 0, -1), true
+	case "tomorrow":
+		return today.AddDate(0, 0, 1), true
+	}
+	if strings.HasPrefix(when, "+") || strings.HasPrefix(when, "-") {
+		offset, err := strconv.Atoi(when)
+		if err != nil || offset > wikiLogMaxOffset || offset < -wikiLogMaxOffset {
+			return time.Time{}, false
+		}
+		return today.AddDate(0, 0, offset), true
+	}
+	day, err := time.ParseInLocation("2006-01-02", when, today.Location())
+	if err != nil {
+		return time.Time{}, false
+	}
+	return day, true
+}
+
+// wikiLogWeekURL uses WIKI_LOG_WEEK_URL_TEMPLATE if set, otherwise the page of the monday of the week
+func wikiLogWeekURL(today time.Time) string {
+	if template := config.WikiLogWeekURLTemplate; template != "" {
+		return wikiLogURL(template, today)
+	}
+	// Weeks start on monday
+	daysSinceMonday := (int(today.Weekday()) + 6) % 7
+	return wikiLogURL(config.WikiLogURLTemplate, today.AddDate(0, 0, -daysSinceMonday))
+}
+
+// wikiLogURL fills the {year}, {month}, {day} and {week} (iso week, {year} is the iso year then) placeholders of the template
+func wikiLogURL(template string, day time.Time) string {
+	if template == "" {
+		template = defaultWikiLogURLTemplate
+	}
+	year := day.Year()
+	isoYear, week := day.ISOWeek()
+	if strings.Contains(template, "{week}") {
+		year = isoYear
+	}
+	return strings.NewReplacer(
+		"{year}", strconv.Itoa(year),
+		"{month}", day.Format("01"),
+		"{day}", day.Format("02"),
+		"{week}", fmt.Sprintf("%02d", week),
+	).Replace(template)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLogDay(t *testing.T) {
+	location := berlinLocation()
+	today := time.Date(2021, time.March, 1, 0, 0, 0, 0, location)
+	tests := []struct {
+		when string
+		day  string
+		ok   bool
+	}{
+		{"today", "2021-03-01", true},
+		{"yesterday", "2021-02-28", true},
+		{"tomorrow", "2021-03-02", true},
+		{"+1", "2021-03-02", true},
+		{"-1", "2021-02-28", true},
+		{"+0", "2021-03-01", true},
+		{"-365", "2020-03-01", true},
+		{"+36500", "2121-02-05", true},
+		{"+36501", "", false},
+		{"-36501", "", false},
+		{"+", "", false},
+		{"+1d", "", false},
+		{"2020-02-29", "2020-02-29", true},
+		{"2021-02-29", "", false},
+		{"2021-3-1", "", false},
+		{"01.03.2021", "", false},
+		{"week", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		day, ok := parseLogDay(test.when, today)
+		if ok != test.ok {
+			t.Errorf("parseLogDay(%q) ok = %v, want %v", test.when, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if got := day.Format("2006-01-02"); got != test.day {
+			t.Errorf("parseLogDay(%q) = %s, want %s", test.when, got, test.day)
+		}
+		if day.Location() != location {
+			t.Errorf("parseLogDay(%q) is in %v, want %v", test.when, day.Location(), location)
+		}
+	}
+}